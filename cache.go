@@ -0,0 +1,115 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Environment variable turning the cache on, when set to 1
+const cacheEnvVar = "CRYSTALFMT_CACHE"
+
+// formatCache remembers the sources known to be formatted, across runs. An
+// entry is an empty file named after the hash of a source, along with the
+// version of the formatter and the options that formatted it.
+type formatCache struct {
+	dir string
+
+	// What, besides the source, the result of formatting depends on
+	keyPrefix string
+}
+
+// cacheDir returns the directory of the cache, under $XDG_CACHE_HOME on Linux
+func cacheDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "crystalfmt"), nil
+}
+
+// openCache returns the cache for formatting with opts
+func openCache(opts options) (*formatCache, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return nil, err
+	}
+	version, err := formatterVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	keyPrefix := fmt.Sprintf("%s\x00indent-size=%d line-width=%d align-comments=%t wrap-comments=%t\x00",
+		version, INDENT_SIZE, opts.lineWidth, opts.alignComments, opts.wrapComments)
+	return &formatCache{dir: dir, keyPrefix: keyPrefix}, nil
+}
+
+var (
+	versionOnce sync.Once
+	version     string
+	versionErr  error
+)
+
+// formatterVersion identifies the running formatter by the hash of its
+// executable, so that a new build never trusts what an older one cached
+func formatterVersion() (string, error) {
+	versionOnce.Do(func() {
+		var path string
+		path, versionErr = os.Executable()
+		if versionErr != nil {
+			return
+		}
+		var file *os.File
+		file, versionErr = os.Open(path)
+		if versionErr != nil {
+			return
+		}
+		defer file.Close()
+
+		hash := sha256.New()
+		if _, versionErr = io.Copy(hash, file); versionErr == nil {
+			version = hex.EncodeToString(hash.Sum(nil))
+		}
+	})
+	return version, versionErr
+}
+
+func (c *formatCache) entryPath(source []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(c.keyPrefix))
+	hash.Write(source)
+	key := hex.EncodeToString(hash.Sum(nil))
+	return filepath.Join(c.dir, key[:2], key)
+}
+
+// isFormatted reports whether source is known to be formatted already
+func (c *formatCache) isFormatted(source []byte) bool {
+	_, err := os.Stat(c.entryPath(source))
+	return err == nil
+}
+
+// markFormatted remembers that source is formatted. Failing to is only
+// reported as a warning, since the cache only saves time.
+func (c *formatCache) markFormatted(source []byte) {
+	path := c.entryPath(source)
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err == nil {
+		err = os.WriteFile(path, nil, 0644)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: unable to update the cache:", err)
+	}
+}
+
+// cleanCache removes every entry of the cache
+func cleanCache() (string, error) {
+	dir, err := cacheDir()
+	if err != nil {
+		return "", err
+	}
+	return dir, os.RemoveAll(dir)
+}
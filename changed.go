@@ -0,0 +1,83 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+// Lines of a file, from first to last, counted from 1
+type lineSpan struct {
+	first int
+	last  int
+}
+
+// changedLines runs git diff to find the lines of the Crystal files under
+// paths that changed since rev, by file name relative to the current
+// directory. Files left untracked aren't included.
+func changedLines(rev string, paths []string) (map[string][]lineSpan, error) {
+	// The prefixes are given since diff.noprefix and diff.mnemonicPrefix
+	// would change them, and parseDiff expects b/
+	args := []string{"diff", "--unified=0", "--no-color", "--no-ext-diff", "--relative",
+		"--src-prefix=a/", "--dst-prefix=b/", rev, "--"}
+	if len(paths) == 0 {
+		args = append(args, "*.cr")
+	}
+	args = append(args, paths...)
+
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Stderr = &stderr
+	diff, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git diff failed: %w: %s", err, strings.TrimSpace(stderr.String()))
+	}
+	return parseDiff(diff)
+}
+
+// parseDiff returns the lines of the new side of every hunk of a unified
+// diff, by file name. Hunks that only delete lines change none.
+func parseDiff(diff []byte) (map[string][]lineSpan, error) {
+	changed := map[string][]lineSpan{}
+	filename := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(diff))
+	scanner.Buffer(nil, len(diff)+1)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "+++ "):
+			filename = ""
+			name := strings.TrimPrefix(line, "+++ ")
+			if unquoted, err := strconv.Unquote(name); err == nil {
+				name = unquoted
+			}
+			if after, ok := strings.CutPrefix(name, "b/"); ok && strings.HasSuffix(after, ".cr") {
+				filename = after
+			}
+
+		case strings.HasPrefix(line, "@@ ") && filename != "":
+			// @@ -<old start>[,<old count>] +<new start>[,<new count>] @@
+			fields := strings.Fields(line)
+			if len(fields) < 3 || !strings.HasPrefix(fields[2], "+") {
+				return nil, fmt.Errorf("invalid hunk header: %s", line)
+			}
+			startText, countText, hasCount := strings.Cut(fields[2][1:], ",")
+			start, err := strconv.Atoi(startText)
+			count := 1
+			if err == nil && hasCount {
+				count, err = strconv.Atoi(countText)
+			}
+			if err != nil {
+				return nil, fmt.Errorf("invalid hunk header: %s", line)
+			}
+			if count > 0 {
+				changed[filename] = append(changed[filename], lineSpan{first: start, last: start + count - 1})
+			}
+		}
+	}
+	return changed, scanner.Err()
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Comments attached to a node. Leading comments are written on the lines
+// right before the node, trailing comments at the end of the line where it
+// ends and dangling comments belong to nodes with nothing to attach them to,
+// like empty arrays.
+type attachedComments struct {
+	leading  []*sitter.Node
+	trailing []*sitter.Node
+	dangling []*sitter.Node
+}
+
+// Nodes whose formatters write their comment children themselves, as
+// statements or at the end of their opening line
+var commentContainers = map[string]bool{
+	"expressions": true,
+	"block":       true,
+	"method_def":  true,
+	"if":          true,
+	"elsif":       true,
+	"then":        true,
+	"else":        true,
+}
+
+var closingDelimiters = map[string]bool{
+	")":   true,
+	"]":   true,
+	"}":   true,
+	"end": true,
+}
+
+// attachComments maps every comment that isn't written as a statement to the
+// nearest node. A comment is trailing the node that ends on the line where
+// it starts, or leading the node that follows it, or dangling on its parent
+// if there are none.
+func (f *Formatter) attachComments(node *sitter.Node) {
+	for ch := range eachChild(node) {
+		if ch.Kind() != "comment" {
+			f.attachComments(ch)
+			continue
+		}
+		if commentContainers[node.Kind()] {
+			continue
+		}
+
+		prev := ch.PrevNamedSibling()
+		for prev != nil && prev.Kind() == "comment" {
+			prev = prev.PrevNamedSibling()
+		}
+		// Comments before a closing delimiter don't lead what comes after it
+		next := ch.NextSibling()
+		for next != nil && (!next.IsNamed() || next.Kind() == "comment") {
+			if closingDelimiters[next.Kind()] {
+				next = nil
+				break
+			}
+			next = next.NextSibling()
+		}
+
+		switch {
+		case prev != nil && prev.Range().EndPoint.Row == ch.Range().StartPoint.Row:
+			f.commentsOf(prev).trailing = append(f.commentsOf(prev).trailing, ch)
+		case next != nil:
+			f.commentsOf(next).leading = append(f.commentsOf(next).leading, ch)
+		default:
+			f.commentsOf(node).dangling = append(f.commentsOf(node).dangling, ch)
+		}
+		f.isAttachedComment[ch.Id()] = true
+	}
+}
+
+// isEndOfLineComment reports whether cmt follows code on the line where it
+// starts
+func isEndOfLineComment(cmt *sitter.Node) bool {
+	prev := cmt.PrevSibling()
+	return prev != nil && prev.Range().EndPoint.Row == cmt.Range().StartPoint.Row
+}
+
+// isFollowedByBlankLine reports whether a blank line separates cmt from what
+// comes after it
+// isOpeningLineComment reports whether cmt is the first comment following
+// code on its line among its siblings. It's the one written at the end of the
+// opening line of a construct, as in def m # c, and any other goes on a line
+// of its own.
+func isOpeningLineComment(cmt *sitter.Node) bool {
+	if !isEndOfLineComment(cmt) {
+		return false
+	}
+	for prev := cmt.PrevSibling(); prev != nil; prev = prev.PrevSibling() {
+		if prev.Kind() == "comment" && isEndOfLineComment(prev) {
+			return false
+		}
+	}
+	return true
+}
+
+func (f *Formatter) isFollowedByBlankLine(cmt *sitter.Node) bool {
+	next := cmt.NextSibling()
+	return next != nil && hasTwoNewlines(f.source[f.getNodeEndPosition(cmt):f.getNodeStartPosition(next)])
+}
+
+func (f *Formatter) commentsOf(node *sitter.Node) *attachedComments {
+	comments, ok := f.comments[node.Id()]
+	if !ok {
+		comments = &attachedComments{}
+		f.comments[node.Id()] = comments
+	}
+	return comments
+}
+
+// writeLeadingComments writes the comments attached before node, each on
+// its own line. Comments before the statements of a body are written as
+// statements too.
+func (f *Formatter) writeLeadingComments(node *sitter.Node, indent int) {
+	comments, ok := f.comments[node.Id()]
+	if !ok {
+		return
+	}
+
+	for _, cmt := range comments.leading {
+		if f.emittedComments[cmt.Id()] {
+			continue
+		}
+
+		if node.Kind() == "expressions" {
+			f.writeIndent(indent)
+			if block := f.docCommentBlock(cmt); block != nil {
+				f.writeDocComment(block, indent)
+			} else {
+				f.formatComment(cmt)
+			}
+			f.writeLF()
+			if f.isFollowedByBlankLine(cmt) {
+				f.writeLF()
+			}
+		} else {
+			f.write(freshLineDoc())
+			f.formatComment(cmt)
+			f.write(alignedLineDoc())
+		}
+	}
+}
+
+// writeTrailingComments writes the comments attached after node. They are
+// held back until the end of the line, so they come after any comma or
+// closing delimiter that follows node.
+func (f *Formatter) writeTrailingComments(node *sitter.Node) {
+	comments, ok := f.comments[node.Id()]
+	if !ok {
+		return
+	}
+
+	for _, cmt := range comments.trailing {
+		f.writeLineSuffixComment(cmt)
+	}
+}
+
+// writeDanglingComments writes the comments that belong inside node, each on
+// its own line, for formatters of delimited lists to call inside their
+// indentation. Dangling comments that no formatter writes are written at the
+// end of the line where node ends.
+func (f *Formatter) writeDanglingComments(node *sitter.Node) {
+	for _, cmt := range f.danglingComments(node) {
+		f.line()
+		f.formatComment(cmt)
+	}
+}
+
+// danglingComments returns the dangling comments of node not yet written
+func (f *Formatter) danglingComments(node *sitter.Node) []*sitter.Node {
+	comments, ok := f.comments[node.Id()]
+	if !ok {
+		return nil
+	}
+
+	var dangling []*sitter.Node
+	for _, cmt := range comments.dangling {
+		if !f.emittedComments[cmt.Id()] {
+			dangling = append(dangling, cmt)
+		}
+	}
+	return dangling
+}
+
+func (f *Formatter) writeRemainingDanglingComments(node *sitter.Node) {
+	for _, cmt := range f.danglingComments(node) {
+		f.writeLineSuffixComment(cmt)
+	}
+}
+
+// normalizeComment adds a space after the '#' of comments missing one.
+// Shebangs (#!), markers like #:nodoc: and separator lines starting with #=
+// are left as they are, but #=> becomes # =>.
+func normalizeComment(cmt string) string {
+	if len(cmt) < 2 || cmt[0] != '#' || cmt[1] == ' ' {
+		return cmt
+	}
+	switch {
+	case cmt[1] == '!', cmt[1] == ':':
+		return cmt
+	case cmt[1] == '=' && !strings.HasPrefix(cmt, "#=>"):
+		return cmt
+	}
+	return "# " + cmt[1:]
+}
+
+// Definitions documented by the comments right above them
+var documentedKinds = map[string]bool{
+	"method_def":          true,
+	"abstract_method_def": true,
+	"macro_def":           true,
+	"class_def":           true,
+	"struct_def":          true,
+	"module_def":          true,
+	"enum_def":            true,
+	"lib_def":             true,
+	"annotation_def":      true,
+}
+
+// docCommentBlock returns the comments of the doc comment that starts with
+// cmt: consecutive comments, each on its own line, right above a definition.
+// It returns nil if cmt doesn't start a doc comment.
+func (f *Formatter) docCommentBlock(cmt *sitter.Node) []*sitter.Node {
+	if cmt.Kind() != "comment" {
+		return nil
+	}
+	if prev := cmt.PrevSibling(); prev != nil {
+		prevRow := prev.Range().EndPoint.Row
+		if prevRow == cmt.Range().StartPoint.Row ||
+			(prev.Kind() == "comment" && prevRow+1 == cmt.Range().StartPoint.Row) {
+			return nil
+		}
+	}
+
+	block := []*sitter.Node{cmt}
+	next := cmt.NextSibling()
+	for next != nil && next.Kind() == "comment" &&
+		next.Range().StartPoint.Row == block[len(block)-1].Range().EndPoint.Row+1 {
+		block = append(block, next)
+		next = next.NextSibling()
+	}
+
+	// Comments before the first statement of a body document that statement
+	for next != nil && next.Kind() == "expressions" {
+		next = next.NamedChild(0)
+	}
+	if next == nil || !documentedKinds[next.Kind()] ||
+		next.Range().StartPoint.Row != block[len(block)-1].Range().EndPoint.Row+1 {
+		return nil
+	}
+	return block
+}
+
+// writeDocComment writes the comments of a doc comment, one per line. Code
+// fences are written as they are and, when wrapping comments, paragraphs of
+// prose are reflowed to the line width.
+func (f *Formatter) writeDocComment(block []*sitter.Node, indent int) {
+	var lines []string
+	var paragraph []string
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			for _, line := range reflowText(paragraph, f.lineWidth-indent-len("# ")) {
+				lines = append(lines, "# "+line)
+			}
+			paragraph = nil
+		}
+	}
+
+	isInFence := false
+	for _, cmt := range block {
+		f.emittedComments[cmt.Id()] = true
+
+		text := f.getContent(cmt)
+		if isInFence && !isCodeFence(text) {
+			lines = append(lines, text)
+			continue
+		}
+
+		text = normalizeComment(text)
+		switch {
+		case isCodeFence(text):
+			flushParagraph()
+			isInFence = !isInFence
+			lines = append(lines, text)
+		case f.wrapComments && isProse(text):
+			paragraph = append(paragraph, strings.TrimPrefix(text, "# "))
+		default:
+			flushParagraph()
+			lines = append(lines, text)
+		}
+	}
+	flushParagraph()
+
+	for idx, line := range lines {
+		if idx > 0 {
+			f.writeLF()
+			f.writeIndent(indent)
+		}
+		f.writeString("%s", strings.TrimRight(line, " "))
+	}
+}
+
+func isCodeFence(cmt string) bool {
+	text := strings.TrimLeft(strings.TrimPrefix(cmt, "#"), " ")
+	return strings.HasPrefix(text, "```") || strings.HasPrefix(text, "~~~")
+}
+
+// isProse reports whether a comment is a line of a paragraph, rather than
+// blank, indented, or markdown that starts a block of its own like a
+// heading, a quote, a table or a list item.
+func isProse(cmt string) bool {
+	text, ok := strings.CutPrefix(cmt, "# ")
+	if !ok || text == "" || text[0] == ' ' {
+		return false
+	}
+
+	switch text[0] {
+	case '#', '>', '|':
+		return false
+	case '-', '*', '+':
+		return len(text) > 1 && text[1] != ' '
+	}
+
+	digits := strings.TrimLeft(text, "0123456789")
+	if len(digits) < len(text) && (strings.HasPrefix(digits, ". ") || strings.HasPrefix(digits, ") ")) {
+		return false
+	}
+	return true
+}
+
+// reflowText fills lines of up to width columns with the words of the given
+// lines. Words longer than width get a line of their own.
+func reflowText(lines []string, width int) []string {
+	var filled []string
+	var current strings.Builder
+	for _, word := range strings.Fields(strings.Join(lines, " ")) {
+		if current.Len() > 0 &&
+			utf8.RuneCountInString(current.String())+1+utf8.RuneCountInString(word) > width {
+			filled = append(filled, current.String())
+			current.Reset()
+		}
+		if current.Len() > 0 {
+			current.WriteByte(' ')
+		}
+		current.WriteString(word)
+	}
+	if current.Len() > 0 {
+		filled = append(filled, current.String())
+	}
+	return filled
+}
+
+func (f *Formatter) writeLineSuffixComment(cmt *sitter.Node) {
+	f.write(trailingCommentDoc(normalizeComment(f.getContent(cmt))))
+	f.emittedComments[cmt.Id()] = true
+}
+
+// alignTrailingComments lines up the comments at the end of consecutive lines
+// of code with the same indentation into a column, as long as the lines stay
+// within width columns. A blank line, a line without a comment or a change
+// of indentation starts a new column.
+func alignTrailingComments(out string, comments []printedComment, width int) string {
+	lines := strings.Split(out, "\n")
+
+	type trailingLine struct {
+		line      int
+		code      string
+		comment   string
+		codeWidth int
+	}
+
+	var run []trailingLine
+	maxCodeWidth, maxCommentWidth := 0, 0
+	flush := func() {
+		for _, tl := range run {
+			padding := strings.Repeat(" ", maxCodeWidth+1-tl.codeWidth)
+			lines[tl.line] = tl.code + padding + tl.comment
+		}
+		run = nil
+		maxCodeWidth, maxCommentWidth = 0, 0
+	}
+
+	for _, cmt := range comments {
+		line := lines[cmt.line]
+		code := strings.TrimRight(line[:cmt.col], " ")
+		tl := trailingLine{
+			line:      cmt.line,
+			code:      code,
+			comment:   line[cmt.col:],
+			codeWidth: utf8.RuneCountInString(code),
+		}
+
+		if len(run) > 0 {
+			last := run[len(run)-1]
+			alignedWidth := max(maxCodeWidth, tl.codeWidth) + 1 +
+				max(maxCommentWidth, utf8.RuneCountInString(tl.comment))
+			if last.line+1 != tl.line ||
+				countIndent([]byte(last.code)) != countIndent([]byte(tl.code)) ||
+				alignedWidth > width {
+				flush()
+			}
+		}
+
+		run = append(run, tl)
+		maxCodeWidth = max(maxCodeWidth, tl.codeWidth)
+		maxCommentWidth = max(maxCommentWidth, utf8.RuneCountInString(tl.comment))
+	}
+	flush()
+
+	return strings.Join(lines, "\n")
+}
+
+// checkComments makes sure that every comment under node was written
+func (f *Formatter) checkComments(node *sitter.Node) {
+	if f.err != nil {
+		return
+	}
+
+	for ch := range eachChild(node) {
+		if ch.Kind() == "comment" && !f.emittedComments[ch.Id()] {
+			f.err = fmt.Errorf("comment at line %d would be lost: %s",
+				ch.Range().StartPoint.Row+1, f.getContent(ch))
+			return
+		}
+		f.checkComments(ch)
+	}
+}
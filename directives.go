@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Comments that turn formatting off and back on for the statements between
+// them, or off for the statement that follows
+const (
+	directiveOff        = "crystalfmt:off"
+	directiveOn         = "crystalfmt:on"
+	directiveIgnoreNext = "crystalfmt:ignore-next"
+)
+
+// A part of the source written as it is
+type verbatimRegion struct {
+	start int
+	end   int
+}
+
+func directiveOf(cmt string) string {
+	return strings.TrimSpace(strings.TrimPrefix(cmt, "#"))
+}
+
+// findDirectives maps the first statement following every formatter
+// directive under node to the region of the source to write verbatim from
+// there. Regions turned off never go past the block where they start.
+func (f *Formatter) findDirectives(node *sitter.Node) {
+	for ch := range eachChild(node) {
+		if ch.Kind() != "comment" {
+			f.findDirectives(ch)
+			continue
+		}
+
+		directive := directiveOf(f.getContent(ch))
+		if directive != directiveOff && directive != directiveIgnoreNext {
+			continue
+		}
+
+		start := nextStatement(ch)
+		if start == nil {
+			continue
+		}
+
+		last := start
+		if directive == directiveOff {
+			last = nil
+			isClosed := false
+			for sib := start; sib != nil; sib = sib.NextSibling() {
+				if sib.Kind() == "comment" && directiveOf(f.getContent(sib)) == directiveOn {
+					isClosed = true
+					break
+				}
+				last = sib
+			}
+			if !isClosed {
+				f.warnings = append(f.warnings, fmt.Sprintf(
+					"%s at line %d is never followed by %s in the same block",
+					directiveOff, ch.Range().StartPoint.Row+1, directiveOn))
+			}
+			if last == nil {
+				continue
+			}
+		}
+
+		// Heredoc bodies come after the statement holding their start
+		for last.NextSibling() != nil && last.NextSibling().Kind() == "heredoc_body" {
+			last = last.NextSibling()
+		}
+
+		f.verbatimRegions[start.Id()] = verbatimRegion{
+			start: f.getNodeStartPosition(start),
+			end:   f.getNodeEndPosition(last),
+		}
+	}
+}
+
+// nextStatement returns the first node after cmt that isn't a comment, or
+// the first statement of the body that follows it
+func nextStatement(cmt *sitter.Node) *sitter.Node {
+	next := cmt.NextNamedSibling()
+	for next != nil && next.Kind() == "comment" {
+		next = next.NextNamedSibling()
+	}
+	for next != nil && (next.Kind() == "expressions" || next.Kind() == "then") {
+		next = next.NamedChild(0)
+	}
+	return next
+}
+
+// Literals whose whitespace is part of their value
+var verbatimLiteralKinds = map[string]bool{
+	"string":       true,
+	"regex":        true,
+	"command":      true,
+	"heredoc_body": true,
+}
+
+// writeVerbatim writes the region of the source starting at node as it is,
+// if there is one. It reports whether it did. Lines of the region are only
+// shifted by however much its first line was reindented, so that it lines up
+// with what's around it, unless they start inside a string.
+func (f *Formatter) writeVerbatim(node *sitter.Node) bool {
+	region, ok := f.verbatimRegions[node.Id()]
+	if !ok {
+		return false
+	}
+
+	lines := strings.SplitAfter(string(f.source[region.start:region.end]), "\n")
+	isInLiteral := map[int]bool{}
+	f.findLiteralLines(node.Parent(), region, isInLiteral)
+
+	// Never remove more whitespace than the least indented line has
+	srcIndent := f.sourceLineIndent(node)
+	firstRow := int(node.Range().StartPoint.Row)
+	minIndent := srcIndent
+	for idx, line := range lines[1:] {
+		if strings.TrimSpace(line) != "" && !isInLiteral[firstRow+idx+1] {
+			minIndent = min(minIndent, countIndent([]byte(line)))
+		}
+	}
+
+	f.write(lazyDoc(func(lineIndent int) string {
+		shift := max(lineIndent-srcIndent, -minIndent)
+
+		var sb strings.Builder
+		for idx, line := range lines {
+			if idx > 0 && !isInLiteral[firstRow+idx] && strings.TrimSpace(line) != "" {
+				if shift > 0 {
+					sb.WriteString(strings.Repeat(" ", shift))
+				} else {
+					line = line[-shift:]
+				}
+			}
+			sb.WriteString(line)
+		}
+		return sb.String()
+	}))
+	f.markCommentsEmittedIn(node.Parent(), region)
+	f.verbatim = region
+	return true
+}
+
+// findLiteralLines records the rows of the lines in region that start inside
+// of a literal
+func (f *Formatter) findLiteralLines(node *sitter.Node, region verbatimRegion, isInLiteral map[int]bool) {
+	for ch := range eachChild(node) {
+		if f.getNodeEndPosition(ch) <= region.start || f.getNodeStartPosition(ch) >= region.end {
+			continue
+		}
+		if verbatimLiteralKinds[ch.Kind()] {
+			// Heredoc bodies start at the start of a line
+			firstRow := ch.Range().StartPoint.Row + 1
+			if ch.Kind() == "heredoc_body" {
+				firstRow--
+			}
+			for row := firstRow; row <= ch.Range().EndPoint.Row; row++ {
+				isInLiteral[int(row)] = true
+			}
+			continue
+		}
+		f.findLiteralLines(ch, region, isInLiteral)
+	}
+}
+
+// isVerbatim reports whether node was written along with the verbatim
+// region of a previous sibling
+func (f *Formatter) isVerbatim(node *sitter.Node) bool {
+	if node == nil {
+		return false
+	}
+	start := f.getNodeStartPosition(node)
+	return start > f.verbatim.start && start < f.verbatim.end
+}
+
+func (f *Formatter) markCommentsEmittedIn(node *sitter.Node, region verbatimRegion) {
+	for ch := range eachChild(node) {
+		if f.getNodeEndPosition(ch) <= region.start || f.getNodeStartPosition(ch) >= region.end {
+			continue
+		}
+		if ch.Kind() == "comment" {
+			f.emittedComments[ch.Id()] = true
+		}
+		f.markCommentsEmittedIn(ch, region)
+	}
+}
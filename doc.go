@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"unicode/utf8"
+)
+
+type docKind int
+
+const (
+	// Plain text, written as is
+	docText docKind = iota
+
+	// A sequence of documents
+	docConcat
+
+	// A space if the enclosing group fits on one line, a line break otherwise
+	docLine
+
+	// Nothing if the enclosing group fits on one line, a line break otherwise
+	docSoftLine
+
+	// Always a line break. Unlike docLine, it isn't followed by any
+	// indentation: the formatter writes that itself. Groups containing one
+	// never fit on a single line.
+	docHardLine
+
+	// A document that is printed on a single line if it fits, or has its
+	// lines broken otherwise
+	docGroup
+
+	// Indents the line breaks of a document one level deeper than the line
+	// where it starts
+	docIndent
+
+	// Chooses between two documents depending on whether the enclosing group
+	// was broken
+	docIfBreak
+
+	// Text that can only be known once the indentation of the line it's
+	// printed on is known
+	docLazy
+
+	// Always a line break, followed by the same indentation as the line it
+	// breaks. Groups containing one never fit on a single line.
+	docAlignedLine
+
+	// A comment at the end of a line of code, held back until right before
+	// the next line break so that it comes after any comma. Groups
+	// containing one never fit on a single line.
+	docLineSuffix
+
+	// A line break like docAlignedLine, unless nothing but indentation was
+	// written on the current line
+	docFreshLine
+
+	// A document printed on a single line even if it doesn't fit, apart from
+	// its hard line breaks
+	docFlat
+)
+
+// Doc is a node of the intermediate document representation built from the
+// syntax tree. Documents are rendered against a target width, so that layout
+// decisions are based on what is printed rather than on the source.
+type Doc struct {
+	kind     docKind
+	text     string
+	children []*Doc
+
+	// For groups, whether the group must be broken regardless of its width
+	shouldBreak bool
+
+	// For docIfBreak, what to print when the enclosing group isn't broken
+	// (children holds what to print when it is)
+	flat []*Doc
+
+	// For docLazy, returns the text given the indentation of the current line
+	lazy func(lineIndent int) string
+}
+
+func textDoc(text string) *Doc {
+	return &Doc{kind: docText, text: text}
+}
+
+func concatDoc(docs ...*Doc) *Doc {
+	return &Doc{kind: docConcat, children: docs}
+}
+
+func lineDoc() *Doc {
+	return &Doc{kind: docLine}
+}
+
+func softLineDoc() *Doc {
+	return &Doc{kind: docSoftLine}
+}
+
+func hardLineDoc() *Doc {
+	return &Doc{kind: docHardLine}
+}
+
+func groupDoc(shouldBreak bool, docs ...*Doc) *Doc {
+	return &Doc{kind: docGroup, children: docs, shouldBreak: shouldBreak}
+}
+
+func flatDoc(docs ...*Doc) *Doc {
+	return &Doc{kind: docFlat, children: docs}
+}
+
+func indentDoc(docs ...*Doc) *Doc {
+	return &Doc{kind: docIndent, children: docs}
+}
+
+func ifBreakDoc(broken []*Doc, flat []*Doc) *Doc {
+	return &Doc{kind: docIfBreak, children: broken, flat: flat}
+}
+
+func lazyDoc(fn func(lineIndent int) string) *Doc {
+	return &Doc{kind: docLazy, lazy: fn}
+}
+
+func alignedLineDoc() *Doc {
+	return &Doc{kind: docAlignedLine}
+}
+
+func freshLineDoc() *Doc {
+	return &Doc{kind: docFreshLine}
+}
+
+// trailingCommentDoc returns a line suffix for a comment at the end of a
+// line of code
+func trailingCommentDoc(cmt string) *Doc {
+	return &Doc{kind: docLineSuffix, text: cmt}
+}
+
+type printMode int
+
+const (
+	modeBreak printMode = iota
+	modeFlat
+)
+
+type printCmd struct {
+	indent int
+	mode   printMode
+	doc    *Doc
+}
+
+type docPrinter struct {
+	out        bytes.Buffer
+	width      int
+	indentSize int
+
+	// Column of the next byte to be written
+	col int
+
+	// Indentation of the line being written
+	lineIndent int
+
+	// Whether only whitespace has been written to the current line
+	atLineStart bool
+
+	// Indentation of the last line started by a hard line break, which is
+	// where the formatter starts statements, and whether the current line
+	// was started by one
+	statementIndent int
+	isStatementLine bool
+
+	// Indentation to write before the next text on the line
+	pendingIndent int
+
+	// Text to write right before the next line break
+	lineSuffixes []*Doc
+
+	// Line being written, and the offset where it starts
+	line      int
+	lineStart int
+
+	// Positions of the comments written at the end of lines of code
+	trailingComments []printedComment
+}
+
+type printedComment struct {
+	line int
+
+	// Byte offset of the comment from the start of the line
+	col int
+}
+
+// printDoc prints doc, breaking the groups that don't fit in width columns
+func printDoc(doc *Doc, width, indentSize int) *docPrinter {
+	propagateBreaks(doc)
+
+	p := &docPrinter{width: width, indentSize: indentSize, atLineStart: true, isStatementLine: true}
+	cmds := []printCmd{{indent: 0, mode: modeBreak, doc: doc}}
+	for len(cmds) > 0 {
+		cmd := cmds[len(cmds)-1]
+		cmds = cmds[:len(cmds)-1]
+
+		switch cmd.doc.kind {
+		case docText:
+			p.writeText(cmd.doc.text)
+
+		case docLazy:
+			p.writeText(cmd.doc.lazy(p.lineIndent))
+
+		case docConcat:
+			cmds = pushDocs(cmds, cmd.indent, cmd.mode, cmd.doc.children)
+
+		case docIndent:
+			cmds = pushDocs(cmds, p.lineIndent+p.indentSize, cmd.mode, cmd.doc.children)
+
+		case docGroup:
+			// Line breaks in a group go back to the indentation of the line
+			// where the group starts. Groups that must be broken are, even
+			// in a flat document.
+			next := printCmd{indent: p.lineIndent, mode: modeFlat, doc: concatDoc(cmd.doc.children...)}
+			if cmd.doc.shouldBreak || (cmd.mode == modeBreak && !p.fits(next, cmds)) {
+				next.mode = modeBreak
+			}
+			cmds = append(cmds, next)
+
+		case docFlat:
+			cmds = pushDocs(cmds, p.lineIndent, modeFlat, cmd.doc.children)
+
+		case docIfBreak:
+			if cmd.mode == modeBreak {
+				cmds = pushDocs(cmds, cmd.indent, cmd.mode, cmd.doc.children)
+			} else {
+				cmds = pushDocs(cmds, cmd.indent, cmd.mode, cmd.doc.flat)
+			}
+
+		case docLine, docSoftLine:
+			if cmd.mode == modeFlat {
+				if cmd.doc.kind == docLine {
+					p.writeText(" ")
+				}
+				continue
+			}
+			p.writeNewline(cmd.indent)
+
+		case docHardLine:
+			p.writeNewline(0)
+			p.isStatementLine = true
+
+		case docAlignedLine:
+			p.writeNewline(p.lineIndent)
+
+		case docFreshLine:
+			if !p.atLineStart {
+				p.writeNewline(p.lineIndent)
+			}
+
+		case docLineSuffix:
+			p.lineSuffixes = append(p.lineSuffixes, cmd.doc)
+		}
+	}
+	p.flushLineSuffixes()
+	p.trimTrailingSpaces()
+
+	return p
+}
+
+func pushDocs(cmds []printCmd, indent int, mode printMode, docs []*Doc) []printCmd {
+	for i := len(docs) - 1; i >= 0; i-- {
+		cmds = append(cmds, printCmd{indent: indent, mode: mode, doc: docs[i]})
+	}
+	return cmds
+}
+
+// fits reports whether next can be printed flat on what's left of the
+// current line, along with whatever follows it up to the next line break
+func (p *docPrinter) fits(next printCmd, rest []printCmd) bool {
+	remaining := p.width - p.col - p.pendingIndent
+	restIdx := len(rest)
+	cmds := []printCmd{next}
+
+	for remaining >= 0 {
+		if len(cmds) == 0 {
+			if restIdx == 0 {
+				return true
+			}
+			restIdx--
+			cmds = append(cmds, rest[restIdx])
+			continue
+		}
+
+		cmd := cmds[len(cmds)-1]
+		cmds = cmds[:len(cmds)-1]
+
+		var text string
+		switch cmd.doc.kind {
+		case docText:
+			text = cmd.doc.text
+		case docLazy:
+			text = cmd.doc.lazy(p.lineIndent)
+		case docConcat, docIndent:
+			cmds = pushDocs(cmds, cmd.indent, cmd.mode, cmd.doc.children)
+		case docGroup:
+			mode := cmd.mode
+			if cmd.doc.shouldBreak {
+				mode = modeBreak
+			}
+			cmds = pushDocs(cmds, cmd.indent, mode, cmd.doc.children)
+		case docFlat:
+			cmds = pushDocs(cmds, cmd.indent, modeFlat, cmd.doc.children)
+		case docIfBreak:
+			if cmd.mode == modeBreak {
+				cmds = pushDocs(cmds, cmd.indent, cmd.mode, cmd.doc.children)
+			} else {
+				cmds = pushDocs(cmds, cmd.indent, cmd.mode, cmd.doc.flat)
+			}
+		case docLine, docSoftLine:
+			if cmd.mode == modeBreak {
+				return true
+			}
+			if cmd.doc.kind == docLine {
+				remaining--
+			}
+		case docHardLine, docAlignedLine, docFreshLine:
+			return true
+		}
+
+		if idx := strings.IndexByte(text, '\n'); idx != -1 {
+			return remaining-utf8.RuneCountInString(text[:idx]) >= 0
+		}
+		remaining -= utf8.RuneCountInString(text)
+	}
+
+	return false
+}
+
+func (p *docPrinter) writeTrailingComment(cmt string) {
+	p.trimTrailingSpaces()
+	p.writeText(" ")
+	p.trailingComments = append(p.trailingComments, printedComment{
+		line: p.line,
+		col:  p.out.Len() - p.lineStart,
+	})
+	p.writeText(cmt)
+}
+
+func (p *docPrinter) writeText(text string) {
+	if text == "" {
+		return
+	}
+	if len(p.lineSuffixes) > 0 && strings.Contains(text, "\n") {
+		before, after, _ := strings.Cut(text, "\n")
+		p.writeText(before)
+		p.flushLineSuffixes()
+		text = "\n" + after
+	}
+	if p.pendingIndent > 0 && text[0] != '\n' {
+		p.out.WriteString(strings.Repeat(" ", p.pendingIndent))
+		p.col += p.pendingIndent
+	}
+	p.pendingIndent = 0
+
+	p.out.WriteString(text)
+
+	if idx := strings.LastIndexByte(text, '\n'); idx != -1 {
+		p.line += strings.Count(text, "\n")
+		p.lineStart = p.out.Len() - len(text) + idx + 1
+		text = text[idx+1:]
+		p.col = 0
+		p.lineIndent = 0
+		p.atLineStart = true
+	}
+	p.col += utf8.RuneCountInString(text)
+
+	if p.atLineStart {
+		indent := countIndent([]byte(text))
+		p.lineIndent += indent
+		p.atLineStart = indent == len(text)
+		if !p.atLineStart && p.isStatementLine {
+			p.statementIndent = p.lineIndent
+		}
+	}
+}
+
+func (p *docPrinter) flushLineSuffixes() {
+	suffixes := p.lineSuffixes
+	p.lineSuffixes = nil
+	for idx, suffix := range suffixes {
+		// Anything after a comment is part of it, so other comments go on
+		// lines of their own, like comments between statements
+		if idx > 0 {
+			p.writeNewline(p.statementIndent)
+			p.writeText(suffix.text)
+			continue
+		}
+		p.writeTrailingComment(suffix.text)
+	}
+}
+
+// trimTrailingSpaces removes the spaces at the end of the current line, like
+// the one before an operand moved to the next line
+func (p *docPrinter) trimTrailingSpaces() {
+	line := p.out.Bytes()[p.lineStart:]
+	trimmed := bytes.TrimRight(line, " ")
+	p.out.Truncate(p.lineStart + len(trimmed))
+	p.col -= len(line) - len(trimmed)
+}
+
+func (p *docPrinter) writeNewline(indent int) {
+	p.flushLineSuffixes()
+	p.trimTrailingSpaces()
+	p.out.WriteByte('\n')
+	p.line++
+	p.lineStart = p.out.Len()
+	p.col = 0
+	p.lineIndent = indent
+	p.atLineStart = true
+	p.isStatementLine = false
+	p.pendingIndent = indent
+}
+
+// propagateBreaks marks every group that contains a hard line break, or a
+// group that must be broken, as a group that must be broken too. It reports
+// whether doc contains any of those.
+func propagateBreaks(doc *Doc) bool {
+	switch doc.kind {
+	case docText:
+		return strings.Contains(doc.text, "\n")
+	case docHardLine, docAlignedLine, docLineSuffix, docFreshLine:
+		return true
+	case docIfBreak:
+		// Which of its documents is printed depends on the enclosing group,
+		// so they don't decide whether it's broken
+		for _, ch := range doc.children {
+			propagateBreaks(ch)
+		}
+		for _, ch := range doc.flat {
+			propagateBreaks(ch)
+		}
+		return false
+	case docConcat, docIndent, docGroup, docFlat:
+		hasBreak := false
+		for _, ch := range doc.children {
+			if propagateBreaks(ch) {
+				hasBreak = true
+			}
+		}
+		if doc.kind == docGroup {
+			doc.shouldBreak = doc.shouldBreak || hasBreak
+			return doc.shouldBreak
+		}
+		return hasBreak
+	}
+	return false
+}
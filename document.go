@@ -0,0 +1,74 @@
+package main
+
+import (
+	"bytes"
+	"slices"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// A source kept parsed as it changes, for long-running modes. Each change
+// is applied to the previous tree, so that reparsing only redoes the part
+// of it the change affects.
+type document struct {
+	parser *sitter.Parser
+	text   []byte
+	tree   *sitter.Tree
+}
+
+func newDocument(parser *sitter.Parser, text []byte) *document {
+	return &document{parser: parser, text: text, tree: parser.Parse(text, nil)}
+}
+
+// edit replaces the bytes of the text from start up to end with newText
+func (d *document) edit(start, end int, newText []byte) {
+	text := slices.Concat(d.text[:start], newText, d.text[end:])
+	newEnd := start + len(newText)
+	d.tree.Edit(&sitter.InputEdit{
+		StartByte:      uint(start),
+		OldEndByte:     uint(end),
+		NewEndByte:     uint(newEnd),
+		StartPosition:  pointAt(d.text, start),
+		OldEndPosition: pointAt(d.text, end),
+		NewEndPosition: pointAt(text, newEnd),
+	})
+	d.reparse(text)
+}
+
+// replace replaces the whole text, as an edit of the part that changed
+func (d *document) replace(text []byte) {
+	prefix := 0
+	for prefix < min(len(d.text), len(text)) && d.text[prefix] == text[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < min(len(d.text), len(text))-prefix &&
+		d.text[len(d.text)-1-suffix] == text[len(text)-1-suffix] {
+		suffix++
+	}
+	if prefix == len(d.text) && prefix == len(text) {
+		return
+	}
+	d.edit(prefix, len(d.text)-suffix, text[prefix:len(text)-suffix])
+}
+
+func (d *document) reparse(text []byte) {
+	tree := d.parser.Parse(text, d.tree)
+	d.tree.Close()
+	d.text = text
+	d.tree = tree
+}
+
+func (d *document) close() {
+	d.tree.Close()
+}
+
+// pointAt returns the row and byte column of an offset of text
+func pointAt(text []byte, offset int) sitter.Point {
+	before := text[:offset]
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	return sitter.Point{
+		Row:    uint(bytes.Count(before, []byte("\n"))),
+		Column: uint(offset - lineStart),
+	}
+}
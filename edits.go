@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// An edit replacing the text from start up to end with newText
+type edit struct {
+	Start   editPosition `json:"start"`
+	End     editPosition `json:"end"`
+	NewText string       `json:"newText"`
+}
+
+// A position in a text as a byte offset, and as a line and column counted
+// from 1. Columns are counted in bytes, and in UTF-16 code units like
+// editors speaking LSP do.
+type editPosition struct {
+	Offset      int `json:"offset"`
+	Line        int `json:"line"`
+	Column      int `json:"column"`
+	UTF16Column int `json:"utf16Column"`
+}
+
+// diffEdits returns the edits turning text into formatted, in order. Lines
+// are matched with the Myers diff algorithm, and the edits of the lines that
+// changed only cover the bytes that differ, so that editors applying them
+// keep their cursors and marks elsewhere.
+func diffEdits(text, formatted []byte) []edit {
+	oldLines := splitLines(text)
+	newLines := splitLines(formatted)
+	matches := matchLines(oldLines, newLines, 0, 0, nil)
+	matches = append(matches, [2]int{len(oldLines), len(newLines)})
+
+	oldOffsets := lineOffsets(oldLines)
+	newOffsets := lineOffsets(newLines)
+	var edits []edit
+	oldIdx, newIdx := 0, 0
+	for _, match := range matches {
+		oldEnd, newEnd := match[0], match[1]
+		switch {
+		case oldIdx == oldEnd && newIdx == newEnd:
+			// Nothing changed since the last match
+		case oldEnd-oldIdx == newEnd-newIdx:
+			// Lines changed one for one, like reindented ones
+			for idx := range oldEnd - oldIdx {
+				edits = appendEdit(edits, text, formatted,
+					oldOffsets[oldIdx+idx], oldOffsets[oldIdx+idx+1],
+					newOffsets[newIdx+idx], newOffsets[newIdx+idx+1])
+			}
+		default:
+			edits = appendEdit(edits, text, formatted,
+				oldOffsets[oldIdx], oldOffsets[oldEnd], newOffsets[newIdx], newOffsets[newEnd])
+		}
+		oldIdx, newIdx = oldEnd+1, newEnd+1
+	}
+	return edits
+}
+
+// Lines of context around the changes of a hunk
+const hunkContext = 3
+
+// A hunk of a unified diff, with its lines counted from 1
+type hunk struct {
+	OldStart int    `json:"oldStart"`
+	OldLines int    `json:"oldLines"`
+	NewStart int    `json:"newStart"`
+	NewLines int    `json:"newLines"`
+	Diff     string `json:"diff"`
+}
+
+// diffHunks returns the hunks of the unified diff from text to formatted.
+// Changes closer than twice the context are part of the same hunk.
+func diffHunks(text, formatted []byte) []hunk {
+	oldLines := splitLines(text)
+	newLines := splitLines(formatted)
+	matches := matchLines(oldLines, newLines, 0, 0, nil)
+	matches = append(matches, [2]int{len(oldLines), len(newLines)})
+
+	// The lines of text from each change's [0] up to [1] became those of
+	// formatted from [2] up to [3]
+	var changes [][4]int
+	oldIdx, newIdx := 0, 0
+	for _, match := range matches {
+		if oldIdx != match[0] || newIdx != match[1] {
+			changes = append(changes, [4]int{oldIdx, match[0], newIdx, match[1]})
+		}
+		oldIdx, newIdx = match[0]+1, match[1]+1
+	}
+
+	var hunks []hunk
+	for len(changes) > 0 {
+		count := 1
+		for count < len(changes) && changes[count][0]-changes[count-1][1] <= 2*hunkContext {
+			count++
+		}
+		group := changes[:count]
+		changes = changes[count:]
+
+		first, last := group[0], group[len(group)-1]
+		oldStart := max(first[0]-hunkContext, 0)
+		oldEnd := min(last[1]+hunkContext, len(oldLines))
+		newStart := first[2] - (first[0] - oldStart)
+		newEnd := last[3] + (oldEnd - last[1])
+
+		var diff strings.Builder
+		fmt.Fprintf(&diff, "@@ -%s +%s @@\n",
+			hunkRange(oldStart, oldEnd-oldStart), hunkRange(newStart, newEnd-newStart))
+		oldIdx := oldStart
+		for _, change := range group {
+			writeHunkLines(&diff, ' ', oldLines[oldIdx:change[0]])
+			writeHunkLines(&diff, '-', oldLines[change[0]:change[1]])
+			writeHunkLines(&diff, '+', newLines[change[2]:change[3]])
+			oldIdx = change[1]
+		}
+		writeHunkLines(&diff, ' ', oldLines[oldIdx:oldEnd])
+
+		hunks = append(hunks, hunk{
+			OldStart: oldStart + 1,
+			OldLines: oldEnd - oldStart,
+			NewStart: newStart + 1,
+			NewLines: newEnd - newStart,
+			Diff:     diff.String(),
+		})
+	}
+	return hunks
+}
+
+// hunkRange returns the range of lines of a hunk header, for count lines
+// from the index start. Empty ranges start at the line before them.
+func hunkRange(start, count int) string {
+	if count == 0 {
+		return fmt.Sprintf("%d,0", start)
+	}
+	if count == 1 {
+		return strconv.Itoa(start + 1)
+	}
+	return fmt.Sprintf("%d,%d", start+1, count)
+}
+
+// writeHunkLines writes lines to a hunk, after the given prefix
+func writeHunkLines(diff *strings.Builder, prefix byte, lines [][]byte) {
+	for _, line := range lines {
+		diff.WriteByte(prefix)
+		diff.Write(line)
+		if !bytes.HasSuffix(line, []byte("\n")) {
+			diff.WriteString("\n\\ No newline at end of file\n")
+		}
+	}
+}
+
+// appendEdit appends the edit replacing the bytes of text from oldStart to
+// oldEnd with those of formatted from newStart to newEnd, leaving out what
+// they start and end with in common
+func appendEdit(edits []edit, text, formatted []byte, oldStart, oldEnd, newStart, newEnd int) []edit {
+	oldPart := text[oldStart:oldEnd]
+	newPart := formatted[newStart:newEnd]
+
+	prefix := 0
+	for prefix < min(len(oldPart), len(newPart)) && oldPart[prefix] == newPart[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < min(len(oldPart), len(newPart))-prefix &&
+		oldPart[len(oldPart)-1-suffix] == newPart[len(newPart)-1-suffix] {
+		suffix++
+	}
+
+	// Edits never split a character
+	for prefix > 0 && prefix < len(oldPart) && !utf8.RuneStart(oldPart[prefix]) {
+		prefix--
+	}
+	for suffix > 0 && !utf8.RuneStart(oldPart[len(oldPart)-suffix]) {
+		suffix--
+	}
+
+	if prefix == len(oldPart) && prefix == len(newPart) {
+		return edits
+	}
+	return append(edits, edit{
+		Start:   positionOf(text, oldStart+prefix),
+		End:     positionOf(text, oldEnd-suffix),
+		NewText: string(newPart[prefix : len(newPart)-suffix]),
+	})
+}
+
+// positionOf returns the position of a byte offset of text
+func positionOf(text []byte, offset int) editPosition {
+	before := text[:offset]
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	return editPosition{
+		Offset:      offset,
+		Line:        bytes.Count(before, []byte("\n")) + 1,
+		Column:      offset - lineStart + 1,
+		UTF16Column: utf16Len(before[lineStart:]) + 1,
+	}
+}
+
+// splitLines splits text after each line break
+func splitLines(text []byte) [][]byte {
+	lines := bytes.SplitAfter(text, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	return lines
+}
+
+// lineOffsets returns the offset where each line starts, followed by the
+// length of the text
+func lineOffsets(lines [][]byte) []int {
+	offsets := make([]int, 0, len(lines)+1)
+	offset := 0
+	for _, line := range lines {
+		offsets = append(offsets, offset)
+		offset += len(line)
+	}
+	return append(offsets, offset)
+}
+
+// matchLines appends the indexes of the lines of a and b that match, in
+// order, as a longest common subsequence. The lines are at aStart and
+// bStart of the whole texts.
+func matchLines(a, b [][]byte, aStart, bStart int, matches [][2]int) [][2]int {
+	prefix := 0
+	for prefix < min(len(a), len(b)) && bytes.Equal(a[prefix], b[prefix]) {
+		matches = append(matches, [2]int{aStart + prefix, bStart + prefix})
+		prefix++
+	}
+	a, b = a[prefix:], b[prefix:]
+	aStart, bStart = aStart+prefix, bStart+prefix
+
+	suffix := 0
+	for suffix < min(len(a), len(b)) && bytes.Equal(a[len(a)-1-suffix], b[len(b)-1-suffix]) {
+		suffix++
+	}
+	a, b = a[:len(a)-suffix], b[:len(b)-suffix]
+
+	if len(a) > 0 && len(b) > 0 {
+		x, y := middleSnake(a, b)
+		if (x > 0 || y > 0) && (x < len(a) || y < len(b)) {
+			matches = matchLines(a[:x], b[:y], aStart, bStart, matches)
+			matches = matchLines(a[x:], b[y:], aStart+x, bStart+y, matches)
+		}
+	}
+
+	for idx := range suffix {
+		matches = append(matches, [2]int{aStart + len(a) + idx, bStart + len(b) + idx})
+	}
+	return matches
+}
+
+// middleSnake searches the shortest edit script from a to b from both ends
+// at once, in linear space, and returns where the two searches meet. It
+// returns -1, -1 if a and b have nothing in common.
+func middleSnake(a, b [][]byte) (int, int) {
+	n, m := len(a), len(b)
+	maxD := (n + m + 1) / 2
+	offset := maxD
+	forward := make([]int, 2*maxD+2)
+	backward := make([]int, 2*maxD+2)
+	for idx := range forward {
+		forward[idx] = -1
+		backward[idx] = -1
+	}
+	forward[offset+1] = 0
+	backward[offset+1] = 0
+
+	delta := n - m
+	// With an odd delta, the searches can only meet while searching forward
+	isOdd := delta%2 != 0
+
+	// Diagonals that went past the end of a or b aren't searched any more
+	kStart1, kEnd1, kStart2, kEnd2 := 0, 0, 0, 0
+	for d := range maxD {
+		for k := -d + kStart1; k <= d-kEnd1; k += 2 {
+			var x int
+			if k == -d || (k != d && forward[offset+k-1] < forward[offset+k+1]) {
+				x = forward[offset+k+1]
+			} else {
+				x = forward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && bytes.Equal(a[x], b[y]) {
+				x++
+				y++
+			}
+			forward[offset+k] = x
+
+			switch {
+			case x > n:
+				kEnd1 += 2
+			case y > m:
+				kStart1 += 2
+			case isOdd:
+				k2 := offset + delta - k
+				if k2 >= 0 && k2 < len(backward) && backward[k2] != -1 && x >= n-backward[k2] {
+					return x, y
+				}
+			}
+		}
+
+		for k := -d + kStart2; k <= d-kEnd2; k += 2 {
+			var x int
+			if k == -d || (k != d && backward[offset+k-1] < backward[offset+k+1]) {
+				x = backward[offset+k+1]
+			} else {
+				x = backward[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && bytes.Equal(a[n-x-1], b[m-y-1]) {
+				x++
+				y++
+			}
+			backward[offset+k] = x
+
+			switch {
+			case x > n:
+				kEnd2 += 2
+			case y > m:
+				kStart2 += 2
+			case !isOdd:
+				k1 := offset + delta - k
+				if k1 >= 0 && k1 < len(forward) && forward[k1] != -1 {
+					x1 := forward[k1]
+					y1 := offset + x1 - k1
+					if x1 >= n-x {
+						return x1, y1
+					}
+				}
+			}
+		}
+	}
+	return -1, -1
+}
@@ -3,7 +3,8 @@ module crystalfmt
 go 1.23.0
 
 require (
-	github.com/crystal-lang-tools/tree-sitter-crystal v0.0.0-20250418164255-07b93b9f9dc3 // indirect
-	github.com/mattn/go-pointer v0.0.1 // indirect
-	github.com/tree-sitter/go-tree-sitter v0.25.0 // indirect
+	github.com/crystal-lang-tools/tree-sitter-crystal v0.0.0-20250418164255-07b93b9f9dc3
+	github.com/tree-sitter/go-tree-sitter v0.25.0
 )
+
+require github.com/mattn/go-pointer v0.0.1 // indirect
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Error codes of JSON-RPC and the Language Server Protocol
+const (
+	rpcParseError     = -32700
+	rpcInvalidParams  = -32602
+	rpcMethodNotFound = -32601
+	rpcRequestFailed  = -32803
+)
+
+// A request, response or notification of JSON-RPC
+type rpcMessage struct {
+	JSONRPC string          `json:"jsonrpc"`
+	ID      json.RawMessage `json:"id,omitempty"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *rpcError       `json:"error,omitempty"`
+}
+
+type rpcError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *rpcError) Error() string {
+	return e.Message
+}
+
+// Positions in LSP count lines from 0, and characters in UTF-16 code units
+type lspPosition struct {
+	Line      int `json:"line"`
+	Character int `json:"character"`
+}
+
+type lspRange struct {
+	Start lspPosition `json:"start"`
+	End   lspPosition `json:"end"`
+}
+
+type textEdit struct {
+	Range   lspRange `json:"range"`
+	NewText string   `json:"newText"`
+}
+
+type diagnostic struct {
+	Range    lspRange `json:"range"`
+	Severity int      `json:"severity"`
+	Source   string   `json:"source"`
+	Message  string   `json:"message"`
+}
+
+type textDocumentID struct {
+	URI string `json:"uri"`
+}
+
+// Parameters of the requests and notifications the server handles
+type (
+	didOpenParams struct {
+		TextDocument struct {
+			URI  string `json:"uri"`
+			Text string `json:"text"`
+		} `json:"textDocument"`
+	}
+
+	didChangeParams struct {
+		TextDocument   textDocumentID `json:"textDocument"`
+		ContentChanges []struct {
+			Range *lspRange `json:"range"`
+			Text  string    `json:"text"`
+		} `json:"contentChanges"`
+	}
+
+	didCloseParams struct {
+		TextDocument textDocumentID `json:"textDocument"`
+	}
+
+	formattingParams struct {
+		TextDocument textDocumentID `json:"textDocument"`
+		Range        lspRange       `json:"range"`
+		Position     lspPosition    `json:"position"`
+		Ch           string         `json:"ch"`
+	}
+)
+
+// lspServer formats the documents an editor opens, speaking the Language
+// Server Protocol over a pair of streams
+type lspServer struct {
+	parser *sitter.Parser
+	out    io.Writer
+
+	// Open documents, by URI
+	docs map[string]*document
+
+	// Whether a shutdown request was received, so that exiting is expected
+	isShutdown bool
+}
+
+func newLSPServer(parser *sitter.Parser, out io.Writer) *lspServer {
+	return &lspServer{parser: parser, out: out, docs: map[string]*document{}}
+}
+
+// serve handles the messages read from in until an exit notification or the
+// end of in, and returns the exit code of the server
+func (s *lspServer) serve(in io.Reader) int {
+	reader := bufio.NewReader(in)
+	for {
+		msg, err := readMessage(reader)
+		if errors.Is(err, io.EOF) {
+			return 1
+		}
+		if err != nil {
+			s.reply(nil, nil, &rpcError{Code: rpcParseError, Message: err.Error()})
+			continue
+		}
+
+		if msg.Method == "exit" {
+			if s.isShutdown {
+				return 0
+			}
+			return 1
+		}
+
+		result, err := s.handle(msg)
+		if msg.ID == nil {
+			// Notifications get no response, even when they fail
+			continue
+		}
+		var rpcErr *rpcError
+		if err != nil && !errors.As(err, &rpcErr) {
+			rpcErr = &rpcError{Code: rpcRequestFailed, Message: err.Error()}
+		}
+		s.reply(msg.ID, result, rpcErr)
+	}
+}
+
+// readMessage reads a message framed by a Content-Length header
+func readMessage(reader *bufio.Reader) (*rpcMessage, error) {
+	header, err := textproto.NewReader(reader).ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	length, err := strconv.Atoi(header.Get("Content-Length"))
+	if err != nil {
+		return nil, fmt.Errorf("invalid Content-Length: %q", header.Get("Content-Length"))
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(reader, body); err != nil {
+		return nil, err
+	}
+	var msg rpcMessage
+	if err := json.Unmarshal(body, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+func (s *lspServer) write(msg *rpcMessage) {
+	msg.JSONRPC = "2.0"
+	body, err := json.Marshal(msg)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Fprintf(s.out, "Content-Length: %d\r\n\r\n%s", len(body), body)
+}
+
+func (s *lspServer) reply(id json.RawMessage, result any, rpcErr *rpcError) {
+	if id == nil {
+		id = json.RawMessage("null")
+	}
+	msg := &rpcMessage{ID: id, Error: rpcErr}
+	if rpcErr == nil {
+		msg.Result = mustMarshal(result)
+	}
+	s.write(msg)
+}
+
+func (s *lspServer) notify(method string, params any) {
+	s.write(&rpcMessage{Method: method, Params: mustMarshal(params)})
+}
+
+func mustMarshal(v any) json.RawMessage {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// handle runs a request or notification, and returns the result of requests
+func (s *lspServer) handle(msg *rpcMessage) (any, error) {
+	switch msg.Method {
+	case "initialize":
+		return map[string]any{
+			"capabilities": map[string]any{
+				// Open and close notifications, and incremental changes
+				"textDocumentSync": map[string]any{
+					"openClose": true,
+					"change":    2,
+				},
+				"documentFormattingProvider":      true,
+				"documentRangeFormattingProvider": true,
+				"documentOnTypeFormattingProvider": map[string]any{
+					"firstTriggerCharacter": "d",
+					"moreTriggerCharacter":  []string{"\n"},
+				},
+			},
+			"serverInfo": map[string]any{"name": "crystalfmt"},
+		}, nil
+
+	case "initialized":
+		return nil, nil
+
+	case "shutdown":
+		s.isShutdown = true
+		return nil, nil
+
+	case "textDocument/didOpen":
+		var params didOpenParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc, ok := s.docs[params.TextDocument.URI]; ok {
+			doc.close()
+		}
+		s.docs[params.TextDocument.URI] = newDocument(s.parser, []byte(params.TextDocument.Text))
+		s.publishDiagnostics(params.TextDocument.URI)
+		return nil, nil
+
+	case "textDocument/didChange":
+		var params didChangeParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		doc, ok := s.docs[params.TextDocument.URI]
+		if !ok {
+			return nil, fmt.Errorf("unknown document: %s", params.TextDocument.URI)
+		}
+		for _, change := range params.ContentChanges {
+			if change.Range == nil {
+				doc.replace([]byte(change.Text))
+				continue
+			}
+			start := positionToOffset(doc.text, change.Range.Start)
+			end := max(start, positionToOffset(doc.text, change.Range.End))
+			doc.edit(start, end, []byte(change.Text))
+		}
+		s.publishDiagnostics(params.TextDocument.URI)
+		return nil, nil
+
+	case "textDocument/didClose":
+		var params didCloseParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		if doc, ok := s.docs[params.TextDocument.URI]; ok {
+			doc.close()
+			delete(s.docs, params.TextDocument.URI)
+		}
+		s.notify("textDocument/publishDiagnostics", map[string]any{
+			"uri":         params.TextDocument.URI,
+			"diagnostics": []diagnostic{},
+		})
+		return nil, nil
+
+	case "textDocument/formatting", "textDocument/rangeFormatting", "textDocument/onTypeFormatting":
+		var params formattingParams
+		if err := unmarshalParams(msg, &params); err != nil {
+			return nil, err
+		}
+		return s.formatDocument(msg.Method, params)
+	}
+
+	if msg.ID != nil {
+		return nil, &rpcError{Code: rpcMethodNotFound, Message: "unknown method: " + msg.Method}
+	}
+	return nil, nil
+}
+
+func unmarshalParams(msg *rpcMessage, params any) error {
+	if err := json.Unmarshal(msg.Params, params); err != nil {
+		return &rpcError{Code: rpcInvalidParams, Message: err.Error()}
+	}
+	return nil
+}
+
+// formatDocument returns the edits formatting a document, the part of it in
+// a range, or the statement ended by the end keyword just typed. Documents
+// with syntax errors are left as they are.
+func (s *lspServer) formatDocument(method string, params formattingParams) ([]textEdit, error) {
+	doc, ok := s.docs[params.TextDocument.URI]
+	if !ok {
+		return nil, fmt.Errorf("unknown document: %s", params.TextDocument.URI)
+	}
+
+	text, tree := doc.text, doc.tree
+	if tree.RootNode().HasError() {
+		return nil, nil
+	}
+
+	f := newFormatter(text, INDENT_SIZE, LINE_WIDTH)
+	switch method {
+	case "textDocument/rangeFormatting":
+		start := positionToOffset(text, params.Range.Start)
+		end := max(start, positionToOffset(text, params.Range.End))
+		if err := f.selectBytes(start, end-start); err != nil {
+			return nil, err
+		}
+	case "textDocument/onTypeFormatting":
+		start, ok := typedEnd(text, positionToOffset(text, params.Position), params.Ch)
+		if !ok {
+			return nil, nil
+		}
+		if err := f.selectBytes(start, len("end")); err != nil {
+			return nil, err
+		}
+	}
+
+	formatted := f.format(tree.RootNode())
+	if f.err == nil {
+		f.err = f.verify(s.parser, tree, formatted)
+	}
+	if f.err != nil {
+		return nil, fmt.Errorf("unable to format: %w", f.err)
+	}
+	// The line break at the end of the file stays, as editors expect
+	if bytes.HasSuffix(text, []byte("\n")) && !strings.HasSuffix(formatted, "\n") {
+		formatted += "\n"
+	}
+	return lspEdits(diffEdits(text, []byte(formatted))), nil
+}
+
+// typedEnd returns the offset of the end keyword finished by typing ch
+// right before offset, either its last letter or a line break after it
+func typedEnd(text []byte, offset int, ch string) (int, bool) {
+	before := text[:offset]
+	if ch == "\n" {
+		before = bytes.TrimRight(before, " \t")
+		before = bytes.TrimSuffix(before, []byte("\n"))
+		before = bytes.TrimRight(before, " \t\r")
+	}
+	if !bytes.HasSuffix(before, []byte("end")) {
+		return 0, false
+	}
+
+	start := len(before) - len("end")
+	if start > 0 {
+		prev, _ := utf8.DecodeLastRune(before[:start])
+		if prev == '.' || isIdentifierRune(prev) {
+			return 0, false
+		}
+	}
+	return start, true
+}
+
+func isIdentifierRune(r rune) bool {
+	return r == '_' || r >= utf8.RuneSelf ||
+		('a' <= r && r <= 'z') || ('A' <= r && r <= 'Z') || ('0' <= r && r <= '9')
+}
+
+// lspEdits converts edits to the text edits of LSP
+func lspEdits(edits []edit) []textEdit {
+	textEdits := []textEdit{}
+	for _, e := range edits {
+		textEdits = append(textEdits, textEdit{
+			Range: lspRange{
+				Start: lspPosition{Line: e.Start.Line - 1, Character: e.Start.UTF16Column - 1},
+				End:   lspPosition{Line: e.End.Line - 1, Character: e.End.UTF16Column - 1},
+			},
+			NewText: e.NewText,
+		})
+	}
+	return textEdits
+}
+
+// publishDiagnostics reports the syntax errors of a document
+func (s *lspServer) publishDiagnostics(uri string) {
+	doc := s.docs[uri]
+
+	diagnostics := []diagnostic{}
+	collectSyntaxErrors(doc.tree.RootNode(), doc.text, &diagnostics)
+	s.notify("textDocument/publishDiagnostics", map[string]any{
+		"uri":         uri,
+		"diagnostics": diagnostics,
+	})
+}
+
+func collectSyntaxErrors(node *sitter.Node, text []byte, diagnostics *[]diagnostic) {
+	if !node.HasError() {
+		return
+	}
+
+	var message string
+	switch {
+	case node.IsMissing():
+		message = fmt.Sprintf("missing %s", node.Kind())
+	case node.IsError():
+		content := node.Utf8Text(text)
+		if idx := strings.IndexByte(content, '\n'); idx != -1 {
+			content = content[:idx] + "..."
+		}
+		message = fmt.Sprintf("syntax error: unexpected %q", content)
+	}
+	if message != "" {
+		*diagnostics = append(*diagnostics, diagnostic{
+			Range: lspRange{
+				Start: offsetToPosition(text, int(node.StartByte())),
+				End:   offsetToPosition(text, int(node.EndByte())),
+			},
+			Severity: 1,
+			Source:   "crystalfmt",
+			Message:  message,
+		})
+		return
+	}
+
+	for ch := range eachChild(node) {
+		collectSyntaxErrors(ch, text, diagnostics)
+	}
+}
+
+// offsetToPosition converts a byte offset of text to an LSP position
+func offsetToPosition(text []byte, offset int) lspPosition {
+	before := text[:offset]
+	lineStart := bytes.LastIndexByte(before, '\n') + 1
+	return lspPosition{
+		Line:      bytes.Count(before, []byte("\n")),
+		Character: utf16Len(before[lineStart:]),
+	}
+}
+
+// positionToOffset converts an LSP position to a byte offset of text.
+// Positions past the end of a line or of text are clamped to it.
+func positionToOffset(text []byte, pos lspPosition) int {
+	offset := 0
+	for line := 0; line < pos.Line; line++ {
+		idx := bytes.IndexByte(text[offset:], '\n')
+		if idx == -1 {
+			return len(text)
+		}
+		offset += idx + 1
+	}
+
+	for units := 0; units < pos.Character && offset < len(text) && text[offset] != '\n'; {
+		r, size := utf8.DecodeRune(text[offset:])
+		units += runeUTF16Len(r)
+		offset += size
+	}
+	return offset
+}
+
+func utf16Len(text []byte) int {
+	units := 0
+	for len(text) > 0 {
+		r, size := utf8.DecodeRune(text)
+		units += runeUTF16Len(r)
+		text = text[size:]
+	}
+	return units
+}
+
+// runeUTF16Len returns the number of UTF-16 code units encoding r. Invalid
+// bytes are replaced by a single one.
+func runeUTF16Len(r rune) int {
+	return max(utf16.RuneLen(r), 1)
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"iter"
+	"maps"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
 
 	crystal "github.com/crystal-lang-tools/tree-sitter-crystal/bindings/go"
@@ -12,74 +16,564 @@ import (
 
 var INDENT_SIZE = 4
 
+var LINE_WIDTH = 80
+
 type Formatter struct {
-	strBuilder         *strings.Builder
 	source             []byte
 	lineStartPositions []int
 	indentSize         int
+	lineWidth          int
 	err                error
+
+	// Documents being built. Writes go to the last one.
+	docStack []*Doc
+
+	// Indentation deltas of heredocs whose start has been written but whose
+	// body hasn't, in the order they appeared in the source. They are only
+	// known once the document is rendered.
+	pendingHeredocs []*int
+
+	// Offsets where heredocs start, by row
+	heredocStarts map[uint][]uint
+
+	// Comments attached to each node, by node id
+	comments map[uintptr]*attachedComments
+
+	// Ids of the comments that are written along with the node they're
+	// attached to, rather than where they appear among their siblings
+	isAttachedComment map[uintptr]bool
+
+	// Ids of the comments written so far
+	emittedComments map[uintptr]bool
+
+	// Whether to align the comments at the end of consecutive lines
+	alignComments bool
+
+	// Whether to reflow the prose of doc comments to the line width
+	wrapComments bool
+
+	// Regions of the source to write as they are, by the id of the node
+	// where they start, and the last one written
+	verbatimRegions map[uintptr]verbatimRegion
+	verbatim        verbatimRegion
+
+	// Problems that didn't keep the source from being formatted
+	warnings []string
+
+	// Nodes of kinds the formatter doesn't know, which were written as
+	// they are
+	unsupported []unsupportedNode
+
+	// Parts of the source to format, or nil to format all of it, and the
+	// parts of the output that were formatted then
+	selections []byteRange
+	formatted  []byteRange
+}
+
+func newFormatter(source []byte, indentSize int, lineWidth int) *Formatter {
+	return &Formatter{
+		source:             source,
+		lineStartPositions: buildLineStartPositions(source),
+		indentSize:         indentSize,
+		lineWidth:          lineWidth,
+		comments:           map[uintptr]*attachedComments{},
+		isAttachedComment:  map[uintptr]bool{},
+		emittedComments:    map[uintptr]bool{},
+		verbatimRegions:    map[uintptr]verbatimRegion{},
+		heredocStarts:      map[uint][]uint{},
+	}
+}
+
+// format builds the document for node and renders it. With selections, only
+// the statements covering them are formatted.
+func (f *Formatter) format(node *sitter.Node) string {
+	f.attachComments(node)
+	f.findDirectives(node)
+	f.findHeredocStarts(node)
+	if f.selections != nil {
+		return f.formatSelection(node)
+	}
+
+	doc := concatDoc()
+	f.docStack = []*Doc{doc}
+	f.formatNode(node, 0)
+	f.checkComments(node)
+	return f.print(doc)
+}
+
+// print renders doc to the line width
+func (f *Formatter) print(doc *Doc) string {
+	p := printDoc(doc, f.lineWidth, f.indentSize)
+	if f.alignComments {
+		return alignTrailingComments(p.out.String(), p.trailingComments, f.lineWidth)
+	}
+	return p.out.String()
+}
+
+// Values of --output
+const (
+	outputText      = "text"
+	outputEditsJSON = "edits-json"
+)
+
+// Options given on the command line
+type options struct {
+	filename      string
+	shouldWrite   bool
+	lineWidth     int
+	alignComments bool
+	wrapComments  bool
+	verify        bool
+
+	// Part of the file to format, as lines counted from 1 or as a byte
+	// offset and length. Zero lines and a negative offset mean all of it.
+	firstLine int
+	lastLine  int
+	offset    int
+	length    int
+
+	// Git revision whose changes to format, in every Crystal file or only in
+	// the one given
+	changedSince string
+
+	// How to print the result: the formatted source, or the edits formatting
+	// it as JSON
+	output string
+
+	// Whether to keep formatting the files under the given directory as
+	// they change
+	watch bool
+
+	// Format of the report to print instead of the formatted source, if
+	// any
+	report string
+
+	// Whether to format the files staged for commit instead of a file
+	staged bool
+
+	// Whether to skip the files the cache knows to be formatted, with
+	// --cache or $CRYSTALFMT_CACHE set to 1, unless --no-cache is given
+	useCache bool
+}
+
+func parseArgs(args []string) (options, error) {
+	opts := options{lineWidth: LINE_WIDTH, offset: -1, length: -1, output: outputText}
+	opts.useCache = os.Getenv(cacheEnvVar) == "1"
+	noCache := false
+
+	for idx := 0; idx < len(args); idx++ {
+		arg := args[idx]
+		name, value, hasValue := strings.Cut(arg, "=")
+
+		// Values follow an '=' or come as the next argument
+		nextValue := func() (string, error) {
+			if hasValue {
+				return value, nil
+			}
+			idx++
+			if idx >= len(args) {
+				return "", fmt.Errorf("%s requires a value", name)
+			}
+			return args[idx], nil
+		}
+
+		switch name {
+		case "--write", "-w":
+			opts.shouldWrite = true
+		case "--line-width":
+			value, err := nextValue()
+			if err != nil {
+				return opts, err
+			}
+			width, err := strconv.Atoi(value)
+			if err != nil || width <= 0 {
+				return opts, fmt.Errorf("invalid line width: %s", value)
+			}
+			opts.lineWidth = width
+		case "--align-comments":
+			opts.alignComments = true
+		case "--wrap-comments":
+			opts.wrapComments = true
+		case "--verify":
+			opts.verify = true
+		case "--watch":
+			opts.watch = true
+		case "--staged":
+			opts.staged = true
+		case "--cache":
+			opts.useCache = true
+		case "--no-cache":
+			noCache = true
+		case "--lines":
+			value, err := nextValue()
+			if err != nil {
+				return opts, err
+			}
+			first, last, isSpan := strings.Cut(value, ":")
+			if !isSpan {
+				last = first
+			}
+			opts.firstLine, err = strconv.Atoi(first)
+			if err == nil {
+				opts.lastLine, err = strconv.Atoi(last)
+			}
+			if err != nil || opts.firstLine < 1 || opts.lastLine < opts.firstLine {
+				return opts, fmt.Errorf("invalid line range: %s", value)
+			}
+		case "--output":
+			value, err := nextValue()
+			if err != nil {
+				return opts, err
+			}
+			if value != outputText && value != outputEditsJSON {
+				return opts, fmt.Errorf("invalid output: %s", value)
+			}
+			opts.output = value
+		case "--format":
+			value, err := nextValue()
+			if err != nil {
+				return opts, err
+			}
+			if value != reportJSON && value != reportSARIF && value != reportCheckstyle {
+				return opts, fmt.Errorf("invalid format: %s", value)
+			}
+			opts.report = value
+		case "--changed-since":
+			value, err := nextValue()
+			if err != nil {
+				return opts, err
+			}
+			opts.changedSince = value
+		case "--offset", "--length":
+			value, err := nextValue()
+			if err != nil {
+				return opts, err
+			}
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return opts, fmt.Errorf("invalid %s: %s", strings.TrimPrefix(name, "--"), value)
+			}
+			if name == "--offset" {
+				opts.offset = n
+			} else {
+				opts.length = n
+			}
+		default:
+			if strings.HasPrefix(arg, "-") {
+				return opts, fmt.Errorf("unknown option: %s", arg)
+			}
+			opts.filename = arg
+		}
+	}
+
+	if opts.staged && (opts.filename != "" || opts.shouldWrite || opts.watch || opts.changedSince != "" ||
+		opts.firstLine > 0 || opts.offset >= 0 || opts.output != outputText) {
+		return opts, fmt.Errorf("--staged formats the files staged for commit in place, and can't be used along with a file or other options")
+	}
+	if opts.filename == "" && opts.changedSince == "" && !opts.staged {
+		return opts, fmt.Errorf("no file given")
+	}
+	if (opts.firstLine > 0 && opts.offset >= 0) ||
+		(opts.changedSince != "" && (opts.firstLine > 0 || opts.offset >= 0)) {
+		return opts, fmt.Errorf("only one of --lines, --offset and --changed-since can be used")
+	}
+	if opts.length >= 0 && opts.offset < 0 {
+		return opts, fmt.Errorf("--length requires --offset")
+	}
+
+	if opts.watch && (opts.changedSince != "" || opts.firstLine > 0 || opts.offset >= 0 || opts.output != outputText) {
+		return opts, fmt.Errorf("--watch formats whole files in place, and can't be used along with other options")
+	}
+	if opts.report != "" && (opts.watch || opts.staged || opts.output != outputText) {
+		return opts, fmt.Errorf("--format can't be used along with --watch, --staged or --output")
+	}
+	if opts.shouldWrite && opts.output != outputText {
+		return opts, fmt.Errorf("--write can't be used along with --output=%s", opts.output)
+	}
+
+	// Files are never written without making sure the result is right
+	if opts.shouldWrite || opts.staged {
+		opts.verify = true
+	}
+
+	// Only whole files are cached, and reports need every file formatted
+	if noCache || opts.watch || opts.staged || opts.report != "" || opts.changedSince != "" || opts.firstLine > 0 || opts.offset >= 0 {
+		opts.useCache = false
+	}
+
+	return opts, nil
+}
+
+// takeStdout returns the real standard output, for messages or reports to go
+// to, and sends anything else printed along the way to standard error
+func takeStdout() *os.File {
+	out := os.Stdout
+	os.Stdout = os.Stderr
+	return out
 }
 
 func main() {
-	if len(os.Args) < 2 {
-		fmt.Println("Usage: crystalfmt <file.cr>")
-		os.Exit(1)
+	if len(os.Args) > 1 && os.Args[1] == "lsp" {
+		os.Exit(newLSPServer(newParser(), takeStdout()).serve(os.Stdin))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "cache" {
+		if len(os.Args) != 3 || os.Args[2] != "clean" {
+			fmt.Println("Usage: crystalfmt cache clean")
+			os.Exit(1)
+		}
+		dir, err := cleanCache()
+		if err != nil {
+			fmt.Println("Failed to clean the cache:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s was removed\n", dir)
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "hook" {
+		if len(os.Args) != 3 || os.Args[2] != "install" {
+			fmt.Println("Usage: crystalfmt hook install")
+			os.Exit(1)
+		}
+		path, err := installHook(".")
+		if err != nil {
+			fmt.Println("Failed to install the hook:", err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s was installed\n", path)
+		return
 	}
 
-	filename := os.Args[1]
-	source, err := os.ReadFile(filename)
+	opts, err := parseArgs(os.Args[1:])
 	if err != nil {
-		fmt.Printf("Failed to read file: %v\n", err)
+		fmt.Println(err)
+		fmt.Println("Usage: crystalfmt [--write] [--line-width <n>] [--align-comments] [--wrap-comments] [--verify] [--cache | --no-cache] [--output text|edits-json | --format json|sarif|checkstyle] [--lines <first>:<last> | --offset <n> [--length <n>] | --changed-since <rev>] <file.cr>")
+		fmt.Println("       crystalfmt --watch [--line-width <n>] [--align-comments] [--wrap-comments] <dir>")
+		fmt.Println("       crystalfmt --staged [--line-width <n>] [--align-comments] [--wrap-comments]")
+		fmt.Println("       crystalfmt lsp")
+		fmt.Println("       crystalfmt cache clean")
+		fmt.Println("       crystalfmt hook install")
+		os.Exit(1)
+	}
+
+	parser := newParser()
+	if opts.watch {
+		err := watch(parser, opts.filename, opts, os.Stdout, nil)
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if opts.staged {
+		if err := formatStaged(parser, ".", opts, os.Stdout); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	out := os.Stdout
+	if opts.report != "" {
+		out = takeStdout()
+	}
+
+	var reports []fileReport
+	isFormatted := true
+	if opts.changedSince == "" {
+		var cache *formatCache
+		if opts.useCache {
+			cache, err = openCache(opts)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Warning: not using the cache:", err)
+			}
+		}
+		report, ok := formatFile(parser, opts.filename, opts, nil, cache)
+		if report != nil {
+			reports = append(reports, *report)
+		}
+		isFormatted = ok
+	} else {
+		var paths []string
+		if opts.filename != "" {
+			paths = append(paths, opts.filename)
+		}
+		changed, err := changedLines(opts.changedSince, paths)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		for _, filename := range slices.Sorted(maps.Keys(changed)) {
+			report, ok := formatFile(parser, filename, opts, changed[filename], nil)
+			if report != nil {
+				reports = append(reports, *report)
+			}
+			isFormatted = isFormatted && ok
+		}
+	}
+	if opts.report == "" {
+		if !isFormatted {
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := printReport(out, opts.report, reports, opts.shouldWrite); err != nil {
+		fmt.Fprintln(os.Stderr, "Failed to print the report:", err)
 		os.Exit(1)
 	}
+	// Files left unformatted fail the check, unless they were written
+	for _, report := range reports {
+		if report.Status == statusError || (report.Status == statusFormatted && !opts.shouldWrite) {
+			os.Exit(1)
+		}
+	}
+}
 
-	// Set up Tree-sitter parser
+// printEdits prints the edits formatting a file as a line of JSON, or why
+// it couldn't be formatted
+func printEdits(filename string, source, formatted []byte, err error) {
+	result := struct {
+		File  string `json:"file"`
+		Edits []edit `json:"edits"`
+		Error string `json:"error,omitempty"`
+	}{File: filename, Edits: []edit{}}
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.Edits = append(result.Edits, diffEdits(source, formatted)...)
+	}
+
+	line, err := json.Marshal(result)
+	if err != nil {
+		panic(err)
+	}
+	fmt.Println(string(line))
+}
+
+// formatterFor returns a formatter for source with the options
+func (opts options) formatterFor(source []byte) *Formatter {
+	f := newFormatter(source, INDENT_SIZE, opts.lineWidth)
+	f.alignComments = opts.alignComments
+	f.wrapComments = opts.wrapComments
+	return f
+}
+
+// newParser sets up a Tree-sitter parser for Crystal
+func newParser() *sitter.Parser {
 	lang := sitter.NewLanguage(crystal.Language())
 	if lang == nil {
 		panic("Unable to load crystal")
 	}
 	parser := sitter.NewParser()
-	err = parser.SetLanguage(lang)
+	err := parser.SetLanguage(lang)
 	if err != nil {
-		fmt.Println("--- failed to set language:", err)
+		fmt.Fprintln(os.Stderr, "--- failed to set language:", err)
 	}
+	return parser
+}
 
-	tree := parser.Parse(source, nil)
+// formatFile formats a file, or only the statements covering the given
+// lines of it, and writes or prints the result. Files the cache, if any,
+// knows to be formatted are left as they are without parsing them. With
+// --format, the report of the file is returned instead of printing anything.
+// Files that couldn't be formatted are left as they are, and reported as not
+// ok.
+func formatFile(parser *sitter.Parser, filename string, opts options, lines []lineSpan, cache *formatCache) (*fileReport, bool) {
+	source, err := os.ReadFile(filename)
+	if err != nil {
+		fmt.Printf("Failed to read file: %v\n", err)
+		os.Exit(1)
+	}
 
-	f := Formatter{
-		strBuilder:         &strings.Builder{},
-		source:             source,
-		lineStartPositions: buildLineStartPositions(source),
-		indentSize:         INDENT_SIZE,
+	if cache != nil && cache.isFormatted(source) {
+		switch {
+		case opts.output == outputEditsJSON:
+			printEdits(filename, source, source, nil)
+		case opts.shouldWrite:
+			fmt.Printf("%s was already formatted\n", filename)
+		default:
+			fmt.Print(string(source))
+		}
+		return nil, true
+	}
+
+	tree := parser.Parse(source, nil)
+	defer tree.Close()
+
+	f := opts.formatterFor(source)
+	switch {
+	case opts.firstLine > 0:
+		lines = append(lines, lineSpan{first: opts.firstLine, last: opts.lastLine})
+	case opts.offset >= 0:
+		err = f.selectBytes(opts.offset, max(opts.length, 0))
+	}
+	for _, span := range lines {
+		if err == nil {
+			err = f.selectLines(span.first, span.last)
+		}
+	}
+	if err != nil {
+		fmt.Printf("%s: %v\n", filename, err)
+		os.Exit(1)
 	}
 
-	f.formatNode(tree.RootNode(), 0)
+	formatted := f.format(tree.RootNode())
+	for _, warning := range f.warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", warning)
+	}
+	if f.err == nil && opts.verify {
+		f.err = f.verify(parser, tree, formatted)
+	}
 
-	formatted := f.strBuilder.String()
+	// Formatting again what formats to itself wouldn't change it, unless
+	// something was worth a warning
+	if cache != nil && f.err == nil && len(f.warnings) == 0 && formatted == string(source) {
+		cache.markFormatted(source)
+	}
 
-	var shouldWrite bool
-	for _, arg := range os.Args {
-		if arg == "--write" || arg == "-w" {
-			shouldWrite = true
-			break
+	if opts.report != "" {
+		report := newFileReport(filename, source, tree.RootNode(), f, formatted)
+		if opts.shouldWrite && report.Status == statusFormatted {
+			if _, err := writeFileAtomic(filename, []byte(formatted)); err != nil {
+				fmt.Fprintf(os.Stderr, "Failed to write file: %v\n", err)
+				os.Exit(1)
+			}
 		}
+		return &report, true
+	}
+
+	if opts.output == outputEditsJSON {
+		printEdits(filename, source, []byte(formatted), f.err)
+		return nil, true
 	}
+
+	// The source is printed as it is, so that the output can always replace
+	// it, but never written
 	if f.err != nil {
-		shouldWrite = false
-		formatted = string(source)
-		fmt.Printf("Unable to format. Error: %s", f.err.Error())
+		fmt.Fprintf(os.Stderr, "%s: unable to format: %v\n", filename, f.err)
+		if !opts.shouldWrite {
+			fmt.Print(string(source))
+		}
+		return nil, false
 	}
 
-	if shouldWrite {
-		err = os.WriteFile(filename, []byte(formatted), 0644)
+	if opts.shouldWrite {
+		changed, err := writeFileAtomic(filename, []byte(formatted))
 		if err != nil {
 			fmt.Printf("Failed to write file: %v\n", err)
 			os.Exit(1)
 		}
-		fmt.Printf("%s was formatted", filename)
+		// Verifying made sure the result formats to itself
+		if cache != nil && len(f.warnings) == 0 {
+			cache.markFormatted([]byte(formatted))
+		}
+		if changed {
+			fmt.Printf("%s was formatted\n", filename)
+		} else {
+			fmt.Printf("%s was already formatted\n", filename)
+		}
 	} else {
 		fmt.Print(formatted)
 	}
+	return nil, true
 }
 
 func (f *Formatter) formatMethod(node *sitter.Node, indent int) {
@@ -90,21 +584,34 @@ func (f *Formatter) formatMethod(node *sitter.Node, indent int) {
 
 	paramsNode := node.ChildByFieldName("params")
 	if paramsNode != nil {
-		f.writeByte('(')
-		f.formatNode(paramsNode, indent)
-		f.writeByte(')')
+		// Parameters that don't fit go one per line
+		f.group(false, func() {
+			f.writeByte('(')
+			f.indent(func() {
+				f.softLine()
+				f.formatNode(paramsNode, indent)
+				f.writeDanglingComments(paramsNode)
+			})
+			f.softLine()
+			f.writeByte(')')
+		})
 	}
 
 	for ch := range eachChild(node) {
-		switch ch.Kind() {
-		case "comment":
+		switch {
+		case ch.Kind() == "comment" && isOpeningLineComment(ch):
+			f.writeLineSuffixComment(ch)
+		case ch.Kind() == "comment":
 			f.writeLF()
 			f.writeIndent(indent + f.indentSize)
 			f.formatNode(ch, indent+f.indentSize)
-		case "expressions":
+			if f.isFollowedByBlankLine(ch) {
+				f.writeLF()
+			}
+		case ch.Kind() == "expressions":
 			f.writeLF()
 			f.formatNode(ch, indent+f.indentSize)
-		case "(", ")":
+		case ch.Kind() == "(" || ch.Kind() == ")":
 			if paramsNode == nil {
 				f.writeContent(ch)
 			}
@@ -117,11 +624,20 @@ func (f *Formatter) formatMethod(node *sitter.Node, indent int) {
 
 }
 
+// formatClass formats classes, structs and modules
 func (f *Formatter) formatClass(node *sitter.Node, indent int) {
 	nameNode := node.ChildByFieldName("name")
 
-	f.writeString("class")
-	f.writeByte(' ')
+	// Keywords, as in abstract class
+	for ch := range eachChild(node) {
+		if ch.Id() == nameNode.Id() {
+			break
+		}
+		if ch.Kind() != "comment" {
+			f.writeContent(ch)
+			f.writeByte(' ')
+		}
+	}
 	f.formatNode(nameNode, indent)
 
 	if superclassNode := node.ChildByFieldName("superclass"); superclassNode != nil {
@@ -129,37 +645,139 @@ func (f *Formatter) formatClass(node *sitter.Node, indent int) {
 		f.formatNode(superclassNode, indent)
 	}
 
+	// Base type of enums
+	if typeNode := node.ChildByFieldName("type"); typeNode != nil {
+		f.writeString(" : ")
+		f.formatNode(typeNode, indent)
+	}
+
 	if bodyNode := node.ChildByFieldName("body"); bodyNode != nil {
 		f.writeLF()
 		f.formatNode(bodyNode, indent+f.indentSize)
 	}
 
+	// Comments in classes without a body
+	for _, cmt := range f.danglingComments(node) {
+		f.writeLF()
+		f.writeIndent(indent + f.indentSize)
+		f.formatComment(cmt)
+	}
+
+	f.writeLF()
+	f.writeIndent(indent)
+	f.writeString("end")
+}
+
+func (f *Formatter) formatCase(node *sitter.Node, indent int) {
+	f.writeString("case")
+	if condNode := node.ChildByFieldName("cond"); condNode != nil {
+		f.writeByte(' ')
+		f.formatNode(condNode, indent)
+	}
+	f.writeHeredocBodies(node)
+
+	for ch := range eachChild(node) {
+		switch ch.Kind() {
+		case "when":
+			f.writeLF()
+			f.writeIndent(indent)
+			f.formatNode(ch, indent)
+		case "else":
+			f.writeLF()
+			f.writeIndent(indent)
+			f.writeString("else")
+			if bodyNode := ch.ChildByFieldName("body"); bodyNode != nil {
+				f.writeLF()
+				f.formatNode(bodyNode, indent+f.indentSize)
+			}
+		}
+	}
+
+	// Comments after the last branch
+	for _, cmt := range f.danglingComments(node) {
+		f.writeLF()
+		f.writeIndent(indent)
+		f.formatComment(cmt)
+	}
+
 	f.writeLF()
 	f.writeIndent(indent)
 	f.writeString("end")
 }
 
+// formatWhen formats a branch of a case. Branches written with `then` on a
+// single line stay that way.
+func (f *Formatter) formatWhen(node *sitter.Node, indent int) {
+	bodyNode := node.ChildByFieldName("body")
+	thenNode := childOfKind(node, "then")
+	isOneLiner := thenNode != nil && bodyNode != nil &&
+		countLF(f.source[f.getNodeEndPosition(thenNode):f.getNodeStartPosition(bodyNode)]) == 0
+
+	f.writeString("when ")
+	for ch, idx := range eachChild(node) {
+		if node.FieldNameForChild(uint32(idx)) == "cond" {
+			f.formatNode(ch, indent)
+		} else if ch.Kind() == "," {
+			f.writeString(", ")
+		}
+	}
+
+	if bodyNode == nil {
+		return
+	}
+	if isOneLiner {
+		f.writeString(" then ")
+		f.formatExpressions(bodyNode, indent+f.indentSize, false)
+		return
+	}
+	f.writeLF()
+	f.formatNode(bodyNode, indent+f.indentSize)
+}
+
 func (f *Formatter) formatRequire(node *sitter.Node) {
 	for ch := range eachChild(node) {
 		switch ch.Kind() {
 		case "require":
-			f.strBuilder.WriteString("require")
-			f.strBuilder.WriteByte(' ')
+			f.writeString("require")
+			f.writeByte(' ')
 		case "string":
 			f.formatString(ch)
 		}
 	}
 }
 
+// formatString formats double quoted strings as well as every other literal
+// that can be interpolated: percent strings like %(...) and %Q<...>, regexes
+// and commands. Delimiters, escapes and modifiers are written as they are.
 func (f *Formatter) formatString(node *sitter.Node) {
 	for ch := range eachChild(node) {
 		switch ch.Kind() {
-		case `"`:
-			f.writeByte('"')
-		case "literal_content":
+		case "literal_content", "escape_sequence":
 			f.formatLiteral(ch)
 		case "interpolation":
 			f.formatInterpolation(ch)
+		default:
+			f.writeContent(ch)
+		}
+	}
+}
+
+func (f *Formatter) formatChar(node *sitter.Node) {
+	f.writeContent(node)
+}
+
+// formatPercentArray formats word lists like %w[a b] and %i[a b], which are
+// always written on a single line with the words separated by one space.
+func (f *Formatter) formatPercentArray(node *sitter.Node) {
+	for ch := range eachChild(node) {
+		switch ch.Kind() {
+		case "[", "]":
+			f.writeContent(ch)
+		default:
+			if prev := ch.PrevSibling(); prev != nil && prev.Kind() != "[" {
+				f.writeByte(' ')
+			}
+			f.writeContent(ch)
 		}
 	}
 }
@@ -175,126 +793,241 @@ func (f *Formatter) formatInterpolation(node *sitter.Node) {
 	}
 }
 
-func (f *Formatter) formatLiteral(node *sitter.Node) {
-	f.writeContent(node)
+func (f *Formatter) formatHeredocStart(node *sitter.Node) {
+	// The body will be shifted by however much the line holding the start
+	// was reindented, so that `<<-` keeps stripping the same amount.
+	srcIndent := f.sourceLineIndent(node)
+	delta := new(int)
+	f.pendingHeredocs = append(f.pendingHeredocs, delta)
+
+	content := f.getContent(node)
+	f.write(lazyDoc(func(lineIndent int) string {
+		*delta = lineIndent - srcIndent
+		return content
+	}))
 }
 
-func (f *Formatter) formatComment(node *sitter.Node) {
-	cmtVal := f.getContent(node)
+func (f *Formatter) formatHeredocBody(node *sitter.Node) {
+	delta := new(int)
+	if len(f.pendingHeredocs) > 0 {
+		delta = f.pendingHeredocs[0]
+		f.pendingHeredocs = f.pendingHeredocs[1:]
+	}
 
-	// If the comment doesn't have a space after '#'
-	if len(cmtVal) > 1 && cmtVal[0] == '#' && cmtVal[1] != ' ' {
-		f.writeByte('#')
-		f.writeByte(' ')
-		if len(cmtVal) > 1 {
-			f.writeString(cmtVal[1:])
+	start := f.getNodeStartPosition(node)
+	end := f.getNodeEndPosition(node)
+	minIndent := minLineIndent(f.source[start:end])
+
+	cursor := start
+	for ch := range eachChild(node) {
+		if ch.Kind() != "interpolation" {
+			continue
 		}
-	} else {
-		f.writeString(cmtVal)
+		chStart := f.getNodeStartPosition(ch)
+		f.writeHeredocText(f.source[cursor:chStart], cursor == start, delta, minIndent)
+		f.formatInterpolation(ch)
+		cursor = f.getNodeEndPosition(ch)
 	}
+	f.writeHeredocText(f.source[cursor:end], cursor == start, delta, minIndent)
 }
 
-func (f *Formatter) formatBlockOneLiner(node *sitter.Node, indent int) {
-	bodyNode := node.ChildByFieldName("body")
-	for ch := range eachChild(node) {
-		switch ch.Kind() {
-		case "do":
-			f.writeByte(' ')
-			f.writeContent(ch)
-		case "|":
-			next := ch.NextSibling()
-			switch next.Kind() {
-			case "param_list":
-				f.writeByte(' ')
-				f.writeContent(ch)
-			case "expressions":
-				f.formatExpressions(ch, 0, false)
-				f.writeContent(ch)
-			}
-		case "{":
-			f.writeByte(' ')
-			f.writeContent(ch)
-		case "}":
-			f.writeContent(ch)
-		case "expressions":
-			f.writeByte(' ')
-			f.formatExpressions(ch, indent, false)
-			f.writeByte(' ')
-		case "end":
-			if bodyNode == nil {
-				f.writeByte(' ')
+// writeHeredocText writes a verbatim piece of a heredoc body, shifting the
+// indentation of every line that starts inside of it by delta. It never
+// removes more whitespace than the least indented line of the body has.
+func (f *Formatter) writeHeredocText(text []byte, atLineStart bool, delta *int, minIndent int) {
+	f.write(lazyDoc(func(int) string {
+		shift := max(*delta, -minIndent)
+
+		var sb strings.Builder
+		for idx, line := range strings.SplitAfter(string(text), "\n") {
+			if (idx > 0 || atLineStart) && strings.TrimSpace(line) != "" {
+				if shift > 0 {
+					sb.WriteString(strings.Repeat(" ", shift))
+				} else {
+					line = line[-shift:]
+				}
 			}
-			f.writeContent(ch)
-		default:
-			f.formatNode(ch, indent)
+			sb.WriteString(line)
 		}
+		return sb.String()
+	}))
+}
+
+// endsOnHeredocStartLine reports whether node spans many lines and ends on
+// the line of a heredoc it starts, so that the heredoc's body comes after it
+func (f *Formatter) endsOnHeredocStartLine(node *sitter.Node) bool {
+	endRow := node.Range().EndPoint.Row
+	if node.Range().StartPoint.Row == endRow {
+		return false
 	}
+	for _, start := range f.heredocStarts[endRow] {
+		if start >= node.StartByte() && start < node.EndByte() {
+			return true
+		}
+	}
+	return false
 }
 
-func (f *Formatter) formatBlock(node *sitter.Node, indent int) {
-	var blockDelimiterStart int
-	var blockDelimiterEnd int
+// findHeredocStarts records where the heredocs under node start, by row
+func (f *Formatter) findHeredocStarts(node *sitter.Node) {
+	if node.Kind() == "heredoc_start" {
+		row := node.Range().StartPoint.Row
+		f.heredocStarts[row] = append(f.heredocStarts[row], node.StartByte())
+		return
+	}
 	for ch := range eachChild(node) {
-		switch ch.Kind() {
-		case "do", "{":
-			blockDelimiterStart = getAbsPosition(ch.Range().EndPoint, f.lineStartPositions)
-		case "end", "}":
-			blockDelimiterEnd = getAbsPosition(ch.Range().StartPoint, f.lineStartPositions)
-		}
+		f.findHeredocStarts(ch)
 	}
+}
 
-	var isMultiline bool
-	idx := blockDelimiterStart
-	for idx < blockDelimiterEnd {
-		if f.source[idx] == '\n' {
-			isMultiline = true
-			break
+// writeHeredocBodies writes the bodies of the heredocs started in the
+// condition of node, on the lines right after it
+func (f *Formatter) writeHeredocBodies(node *sitter.Node) {
+	for ch := range eachChild(node) {
+		if ch.Kind() == "heredoc_body" {
+			f.writeLF()
+			f.formatNode(ch, 0)
 		}
-		idx++
 	}
+}
 
-	if !isMultiline {
-		f.formatBlockOneLiner(node, indent)
-		return
-	}
+func (f *Formatter) formatLiteral(node *sitter.Node) {
+	// Comments can only be in an empty pair of parentheses, as in (#...)
+	f.writeRawContent(node)
+}
+
+func (f *Formatter) formatComment(node *sitter.Node) {
+	f.writeString("%s", normalizeComment(f.getContent(node)))
+	f.emittedComments[node.Id()] = true
+}
 
+func (f *Formatter) formatBlock(node *sitter.Node, indent int) {
+	var openNode *sitter.Node
+	var closeNode *sitter.Node
 	for ch := range eachChild(node) {
 		switch ch.Kind() {
-		case "do":
-			f.writeByte(' ')
-			f.writeContent(ch)
-		case "|":
-			next := ch.NextSibling()
-			switch next.Kind() {
-			case "param_list":
+		case "do", "{":
+			openNode = ch
+		case "end", "}":
+			closeNode = ch
+		}
+	}
+
+	// do ... end blocks always get a line for their body, while blocks with
+	// braces are only broken when they don't fit or hold comments
+	f.group(openNode != nil && openNode.Kind() == "do" || childOfKind(node, "comment") != nil, func() {
+		bodyNode := node.ChildByFieldName("body")
+		for ch := range eachChild(node) {
+			switch ch.Kind() {
+			case "do", "{":
 				f.writeByte(' ')
 				f.writeContent(ch)
+			case "|":
+				// Opening pipe
+				if next := ch.NextSibling(); next != nil && next.Kind() == "param_list" {
+					f.writeByte(' ')
+				}
+				f.writeContent(ch)
+			case "param_list":
+				// Block parameters only break if they don't fit themselves
+				f.group(false, func() {
+					f.formatParamList(ch)
+				})
+			case "comment":
+				// Comments after the opening line go before the body
+				if isOpeningLineComment(ch) {
+					f.writeLineSuffixComment(ch)
+				} else {
+					f.writeLF()
+					f.writeIndent(indent + f.indentSize)
+					f.formatComment(ch)
+					if f.isFollowedByBlankLine(ch) {
+						f.writeLF()
+					}
+				}
 			case "expressions":
-				f.formatExpressions(ch, 0, false)
+				f.ifBreak(func() {
+					f.writeLF()
+					f.writeIndent(indent + f.indentSize)
+				}, func() {
+					f.writeByte(' ')
+				})
+				f.formatExpressions(ch, indent+f.indentSize, false)
+				f.ifBreak(func() {
+					f.writeLF()
+					f.writeIndent(indent)
+				}, func() {
+					f.writeByte(' ')
+				})
+				f.writeContent(closeNode)
+			case "end", "}":
+				// Written after the body
+				if bodyNode != nil {
+					continue
+				}
+				f.ifBreak(func() {
+					f.writeLF()
+					f.writeIndent(indent)
+				}, func() {
+					if ch.Kind() == "end" {
+						f.writeByte(' ')
+					}
+				})
 				f.writeContent(ch)
+			default:
+				f.formatNode(ch, indent)
 			}
-		case "{":
-			f.writeByte(' ')
-			f.writeContent(ch)
-		case "}":
+		}
+	})
+}
+
+func (f *Formatter) formatBlockArgument(node *sitter.Node, indent int) {
+	for ch := range eachChild(node) {
+		switch ch.Kind() {
+		case "&":
 			f.writeContent(ch)
-		case "param_list":
+		case "implicit_object_call":
+			// Short block syntax, e.g. &.to_s
+			f.formatImplicitObjectCall(ch)
+		default:
 			f.formatNode(ch, indent)
-		case "expressions":
-			f.writeLF()
-			f.formatExpressions(ch, indent+f.indentSize, true)
-			f.writeLF()
-		case "end":
+		}
+	}
+}
+
+// formatProc formats proc literals like ->(x : Int32) : Int32 { x }. The body
+// is a regular block, so it's only broken when it doesn't fit.
+func (f *Formatter) formatProc(node *sitter.Node, indent int) {
+	for ch, idx := range eachChild(node) {
+		switch ch.Kind() {
+		case "->", "(", ")":
 			f.writeContent(ch)
+		case "param_list":
+			f.group(false, func() {
+				f.formatParamList(ch)
+			})
+		case "block":
+			f.formatBlock(ch, indent)
 		default:
+			if node.FieldNameForChild(uint32(idx)) == "type" {
+				f.writeString(" : ")
+			}
 			f.formatNode(ch, indent)
 		}
 	}
 }
 
-func (f *Formatter) formatBlockArgument(node *sitter.Node) {
+// formatMethodProc formats proc pointers like ->foo and ->obj.bar(String)
+func (f *Formatter) formatMethodProc(node *sitter.Node) {
 	for ch := range eachChild(node) {
-		f.formatNode(ch, 0)
+		switch ch.Kind() {
+		case "param_list":
+			f.group(false, func() {
+				f.formatParamList(ch)
+			})
+		default:
+			f.formatNode(ch, 0)
+		}
 	}
 }
 
@@ -362,58 +1095,177 @@ func (f *Formatter) formatParamList(node *sitter.Node) {
 		switch ch.Kind() {
 		case "(", ")":
 			f.writeContent(ch)
-		case "param":
-			f.formatParam(ch)
-		case "block_param":
-			f.formatBlockParam(ch)
-		case "splat_param":
-			f.formatSplatParam(ch)
+		case ",":
+			f.writeContent(ch)
+			f.line()
+		default:
+			f.formatNode(ch, 0)
+		}
+	}
+}
+
+// formatAssign formats plain, operator (+=, ||=, ...) and multiple
+// assignments. Both sides are formatted recursively, so chained assignments
+// like @a = @b = 0 and targets like h[k] or obj.name are handled as well.
+func (f *Formatter) formatAssign(node *sitter.Node, indent int) {
+	for ch := range eachChild(node) {
+		switch ch.Kind() {
+		case "=":
+			f.writeString(" = ")
 		case ",":
 			f.writeString(", ")
+		case "operator":
+			f.formatOperator(ch)
+		default:
+			f.formatNode(ch, indent)
+		}
+	}
+}
+
+func (f *Formatter) formatCall(node *sitter.Node, indent int) {
+	// A single call is formatted as a chain when a heredoc body comes before
+	// its dot, which then has to go on the line after the body
+	chain := callChain(node)
+	isChain := len(chain) >= 2 || (len(chain) == 1 && childOfKind(node, "heredoc_body") != nil)
+	if isChain && !isChainedReceiver(node) {
+		f.formatCallChain(chain, indent)
+		return
+	}
+
+	for ch := range eachChild(node) {
+		f.formatCallPart(ch, indent)
+	}
+}
+
+// formatCallChain formats chains of method calls like a.b.c. Chains that
+// don't fit, or that were written with leading dots, get a line for each
+// call, indented one level deeper than the line the chain starts on.
+func (f *Formatter) formatCallChain(chain []*sitter.Node, indent int) {
+	last := chain[len(chain)-1]
+	lastBlock := last.ChildByFieldName("block")
+
+	shouldBreak := false
+	for _, call := range chain {
+		if dot := childOfKind(call, "."); dot != nil {
+			receiver := call.ChildByFieldName("receiver")
+			between := f.source[f.getNodeEndPosition(receiver):f.getNodeStartPosition(dot)]
+			if countLF(between) > 0 {
+				shouldBreak = true
+			}
+		}
+	}
+
+	f.group(shouldBreak, func() {
+		f.formatNode(chain[0].ChildByFieldName("receiver"), indent)
+		f.indent(func() {
+			for _, call := range chain {
+				for ch, idx := range eachChild(call) {
+					switch {
+					case call.FieldNameForChild(uint32(idx)) == "receiver":
+					case lastBlock != nil && ch.Id() == lastBlock.Id():
+					case ch.Kind() == ".":
+						f.softLine()
+						f.writeContent(ch)
+					case ch.Kind() == "comment":
+						// Comments between links are attached to calls that
+						// aren't formatted as nodes, so they're written here
+						if f.emittedComments[ch.Id()] {
+							continue
+						}
+						if isEndOfLineComment(ch) {
+							f.writeLineSuffixComment(ch)
+						} else {
+							f.write(freshLineDoc())
+							f.formatComment(ch)
+							if next := ch.NextSibling(); next != nil && next.Kind() != "." {
+								f.write(alignedLineDoc())
+							}
+						}
+					case call.FieldNameForChild(uint32(idx)) == "block":
+						// Blocks in the middle don't break the chain, and their
+						// body is indented from the line of their call
+						f.ifBreak(func() {
+							f.formatCallPart(ch, indent+f.indentSize)
+						}, func() {
+							f.formatCallPart(ch, indent)
+						})
+					default:
+						f.formatCallPart(ch, indent)
+					}
+				}
+			}
+		})
+	})
+
+	// A block given to the last call doesn't break the chain
+	if lastBlock != nil {
+		f.formatNode(lastBlock, indent)
+	}
+}
+
+func (f *Formatter) formatCallPart(node *sitter.Node, indent int) {
+	switch node.Kind() {
+	case "expressions":
+		f.formatExpressions(node, indent, false)
+	case "heredoc_body":
+		f.writeLF()
+		f.formatNode(node, indent)
+		// The rest of the call goes on the line after the body
+		if next := node.NextSibling(); next != nil && next.Kind() != "." {
+			f.writeLF()
+			f.writeIndent(indent + f.indentSize)
+		}
+	case "argument_list":
+		var prevType string
+		var firstChildType string
+
+		if node.PrevSibling() != nil {
+			prevType = node.PrevSibling().Kind()
+		}
+		if node.ChildCount() > 0 {
+			firstChildType = node.Child(0).Kind()
 		}
+
+		// Check for a method call not using parentheses. If this is the case,
+		// a space is added between the identifier and the next character.
+		// Operators are method names too when called after a dot, as in a.+ 1
+		isMethodName := prevType == "identifier" || prevType == "constant"
+		if prevType == "operator" {
+			dot := node.PrevSibling().PrevSibling()
+			isMethodName = dot != nil && dot.Kind() == "."
+		}
+		if isMethodName && firstChildType != "(" {
+			f.writeByte(' ')
+		}
+		f.formatNode(node, indent)
+	default:
+		f.formatNode(node, indent)
 	}
 }
 
-func (f *Formatter) formatAssign(node *sitter.Node, indent int) {
-	left := node.ChildByFieldName("lhs")
-	right := node.ChildByFieldName("rhs")
-
-	f.writeContent(left)
-
-	f.strBuilder.WriteString(" = ")
-
-	// Format the right hand side if it exists
-	if right != nil {
-		f.formatNode(right, indent)
+// callChain returns the calls chained with dots that end in node, starting
+// from the innermost one
+func callChain(node *sitter.Node) []*sitter.Node {
+	var chain []*sitter.Node
+	for curr := node; curr != nil && isDotCall(curr); curr = curr.ChildByFieldName("receiver") {
+		chain = append([]*sitter.Node{curr}, chain...)
 	}
+	return chain
 }
 
-func (f *Formatter) formatCall(node *sitter.Node, indent int) {
-	for ch := range eachChild(node) {
-		switch ch.Kind() {
-		case "expressions":
-			f.formatExpressions(ch, indent, false)
-		case "argument_list":
-			var prevType string
-			var firstChildType string
-
-			if ch.PrevSibling() != nil {
-				prevType = ch.PrevSibling().Kind()
-			}
-			if ch.ChildCount() > 0 {
-				firstChildType = ch.Child(0).Kind()
-			}
-
-			// Check for a method call not using parentheses. If this is the case,
-			// a space is added between the identifier and the next character
-			if prevType == "identifier" && firstChildType != "(" {
-				f.writeByte(' ')
-			}
-			fallthrough
-		default:
-			f.formatNode(ch, indent)
-		}
+// isChainedReceiver reports whether node is the receiver of another call in
+// a chain, in which case the outer call formats the whole chain
+func isChainedReceiver(node *sitter.Node) bool {
+	parent := node.Parent()
+	if parent == nil || !isDotCall(parent) {
+		return false
 	}
+	receiver := parent.ChildByFieldName("receiver")
+	return receiver != nil && receiver.Id() == node.Id()
+}
+
+func isDotCall(node *sitter.Node) bool {
+	return node.Kind() == "call" && node.ChildByFieldName("receiver") != nil && childOfKind(node, ".") != nil
 }
 
 func (f *Formatter) formatNamedExpr(node *sitter.Node) {
@@ -428,36 +1280,108 @@ func (f *Formatter) formatNamedExpr(node *sitter.Node) {
 	}
 }
 
+// formatArguments formats argument lists, which go one argument per line when
+// they don't fit. Arguments of calls without parentheses are continued on the
+// following lines.
 func (f *Formatter) formatArguments(node *sitter.Node, indent int) {
-	for ch := range eachChild(node) {
-		switch ch.Kind() {
-		case ",":
-			f.strBuilder.WriteString(", ")
-		case "expressions":
-			f.formatExpressions(ch, 0, false)
-		case "named_expr":
-			f.formatNamedExpr(ch)
-		default:
-			f.formatNode(ch, indent)
+	hasParens := node.ChildCount() > 0 && node.Child(0).Kind() == "("
+
+	format := func() {
+		if hasParens {
+			f.writeByte('(')
+		}
+		f.indent(func() {
+			if hasParens {
+				f.softLine()
+			}
+			for ch := range eachChild(node) {
+				if f.isVerbatim(ch) {
+					// The line still breaks after a region turned off
+					if ch.Kind() == "," && f.getNodeEndPosition(ch) == f.verbatim.end {
+						f.line()
+					}
+					continue
+				}
+				switch ch.Kind() {
+				case "(", ")":
+				case ",":
+					f.writeContent(ch)
+					if next := ch.NextSibling(); next == nil || next.Kind() != "heredoc_body" {
+						f.line()
+					}
+				case "expressions":
+					f.formatExpressions(ch, 0, false)
+				case "heredoc_body":
+					// The body of a heredoc followed by more arguments comes
+					// before them, on the lines after the one where it starts
+					f.writeLF()
+					f.formatNode(ch, indent)
+					if next := ch.NextSibling(); next != nil && next.Kind() == ")" {
+						f.writeLF()
+						f.writeIndent(indent)
+					} else if next != nil {
+						f.writeLF()
+						f.writeIndent(indent + f.indentSize)
+					}
+				default:
+					f.formatNode(ch, indent)
+				}
+			}
+			if hasParens {
+				f.writeDanglingComments(node)
+			}
+		})
+		if hasParens {
+			f.softLine()
+			f.writeByte(')')
 		}
+	}
 
+	// Arguments after the body of a heredoc stay on the lines it leaves them
+	if childOfKind(node, "heredoc_body") != nil {
+		f.write(flatDoc(f.build(format)))
+		return
 	}
+	f.group(false, format)
 }
 
 func (f *Formatter) formatExpressions(node *sitter.Node, indent int, multiline bool) {
+	if first := node.Child(0); first != nil && first.Kind() == "(" {
+		f.formatParenthesized(node, indent)
+		return
+	}
+
+	var stmts []*sitter.Node
 	for ch := range eachChild(node) {
+		stmts = append(stmts, ch)
+	}
+	f.formatStatements(stmts, indent, multiline)
+}
+
+// formatStatements formats consecutive statements of the same body, each on
+// its own line. The first one starts wherever the caller left off unless
+// multiline is set.
+func (f *Formatter) formatStatements(stmts []*sitter.Node, indent int, multiline bool) {
+	for idx, ch := range stmts {
+		// The rest of a doc comment, written along with its first line
+		if ch.Kind() == "comment" && f.emittedComments[ch.Id()] {
+			continue
+		}
+		if f.isVerbatim(ch) {
+			continue
+		}
+
 		isInlineComment := false
-		if prev := ch.PrevSibling(); prev != nil {
+		if prev := ch.PrevSibling(); prev != nil && idx > 0 {
 			prevEnd := getAbsPosition(prev.Range().EndPoint, f.lineStartPositions)
 			currStart := getAbsPosition(ch.Range().StartPoint, f.lineStartPositions)
 			between := f.source[prevEnd:currStart]
 
 			if ch.Kind() == "comment" && countLF(between) == 0 {
 				isInlineComment = true
-				f.writeByte(' ')
 			} else {
 				switch prev.Kind() {
-				case "class_def", "method_def":
+				case "class_def", "struct_def", "module_def", "enum_def", "method_def":
 					f.writeLF()
 					f.writeLF()
 				default:
@@ -469,17 +1393,62 @@ func (f *Formatter) formatExpressions(node *sitter.Node, indent int, multiline b
 			}
 		}
 
-		if !isInlineComment {
+		if isInlineComment {
+			f.writeLineSuffixComment(ch)
+			continue
+		}
+
+		// Expressions that aren't multiline start wherever the caller left
+		// off. Heredoc bodies carry their own indentation.
+		if ch.Kind() != "heredoc_body" && (multiline || idx > 0) {
 			f.writeIndent(indent)
 		}
+		if block := f.docCommentBlock(ch); block != nil {
+			f.writeDocComment(block, indent)
+			continue
+		}
 		f.formatNode(ch, indent)
 	}
 }
 
+// formatParenthesized formats expressions wrapped in parentheses, like the
+// (a + b) in (a + b) * c, keeping them on a single line.
+func (f *Formatter) formatParenthesized(node *sitter.Node, indent int) {
+	// Comments can't be followed by anything on their line
+	if childOfKind(node, "comment") != nil {
+		f.writeRawContent(node)
+		return
+	}
+
+	for ch := range eachChild(node) {
+		switch ch.Kind() {
+		case "(", ")":
+			f.writeContent(ch)
+		case ";":
+		default:
+			if prev := ch.PrevNamedSibling(); prev != nil {
+				f.writeString("; ")
+			}
+			f.formatNode(ch, indent)
+		}
+	}
+}
+
 func (f *Formatter) formatOperator(node *sitter.Node) {
+	// Unary operators come before their operand, as in -x, ~x and !x, and
+	// operator methods are called like others, as in a.+(b)
+	prev := node.PrevSibling()
+	for prev != nil && prev.Kind() == "comment" {
+		prev = prev.PrevSibling()
+	}
+	if prev == nil || prev.Kind() == "." {
+		f.writeContent(node)
+		return
+	}
+
 	content := f.getContent(node)
 	switch content {
-	case "[", ".+":
+	case "[", "..", "...":
 		f.writeString(content)
 	default:
 		f.writeByte(' ')
@@ -488,6 +1457,58 @@ func (f *Formatter) formatOperator(node *sitter.Node) {
 	}
 }
 
+// formatRange formats ranges with no spaces around the operator, as in 1..10.
+// Either end may be missing for beginless and endless ranges.
+func (f *Formatter) formatRange(node *sitter.Node, indent int) {
+	for ch := range eachChild(node) {
+		switch ch.Kind() {
+		case "operator":
+			f.writeContent(ch)
+		default:
+			f.formatNode(ch, indent)
+		}
+	}
+}
+
+// formatBinary formats chains of the boolean operators && and ||. Chains that
+// don't fit are broken after each operator.
+func (f *Formatter) formatBinary(node *sitter.Node, indent int) {
+	// Nested operators belong to the chain of the outermost one
+	if parent := node.Parent(); parent != nil && isBinary(parent) {
+		f.formatBinaryOperands(node, indent)
+		return
+	}
+
+	f.group(false, func() {
+		f.indent(func() {
+			f.formatBinaryOperands(node, indent)
+		})
+	})
+}
+
+func (f *Formatter) formatBinaryOperands(node *sitter.Node, indent int) {
+	for ch := range eachChild(node) {
+		switch ch.Kind() {
+		case "operator":
+			f.writeByte(' ')
+			f.writeContent(ch)
+			f.line()
+		default:
+			f.formatNode(ch, indent)
+		}
+	}
+}
+
+func isBinary(node *sitter.Node) bool {
+	return node.Kind() == "and" || node.Kind() == "or"
+}
+
+func (f *Formatter) formatNot(node *sitter.Node, indent int) {
+	for ch := range eachChild(node) {
+		f.formatNode(ch, indent)
+	}
+}
+
 func (f *Formatter) formatIf(node *sitter.Node, indent int) {
 
 	condNode := node.ChildByFieldName("cond")
@@ -506,20 +1527,34 @@ func (f *Formatter) formatIf(node *sitter.Node, indent int) {
 		} else {
 			f.formatNode(condNode, indent)
 		}
+		for ch := range eachChild(node) {
+			if ch.Kind() == "comment" && isOpeningLineComment(ch) {
+				f.writeLineSuffixComment(ch)
+			}
+		}
+		f.writeHeredocBodies(node)
 
 		for ch := range eachChild(node) {
-			if ch.Kind() == "comment" {
+			if ch.Kind() == "comment" && !isOpeningLineComment(ch) {
 				f.writeLF()
 				f.writeIndent(indent + f.indentSize)
 				f.formatNode(ch, indent)
+				if f.isFollowedByBlankLine(ch) {
+					f.writeLF()
+				}
 			}
 		}
 
 		// Write then
 		if thenNode := node.ChildByFieldName("then"); thenNode != nil {
 			for ch := range eachChild(thenNode) {
+				if f.isVerbatim(ch) {
+					continue
+				}
 				f.writeLF()
-				f.writeIndent(indent + f.indentSize)
+				if ch.Kind() != "heredoc_body" {
+					f.writeIndent(indent + f.indentSize)
+				}
 				f.formatNode(ch, indent+f.indentSize)
 			}
 		}
@@ -582,8 +1617,7 @@ func (f *Formatter) formatYield(node *sitter.Node) {
 			// if previous sibling does not end in '\n', prepend a ' '
 			if sib := ch.PrevSibling(); sib != nil {
 				endPos := getAbsPosition(sib.Range().EndPoint, f.lineStartPositions)
-				endByte := f.source[endPos]
-				if endByte != '\n' {
+				if endPos >= len(f.source) || f.source[endPos] != '\n' {
 					f.writeByte(' ')
 				}
 			}
@@ -610,49 +1644,127 @@ func (f *Formatter) formatModifierIf(node *sitter.Node) {
 }
 
 func (f *Formatter) formatArray(node *sitter.Node, indent int) {
+	if strings.HasPrefix(f.getContent(node), "%") {
+		f.formatPercentArray(node)
+		return
+	}
+
+	f.formatCollection(node, indent)
+}
+
+func (f *Formatter) formatHash(node *sitter.Node, indent int) {
+	f.formatCollection(node, indent)
+}
 
-	var brackOpenNode *sitter.Node
-	var brackCloseNode *sitter.Node
+func (f *Formatter) formatHashEntry(node *sitter.Node, indent int) {
 	for ch := range eachChild(node) {
 		switch ch.Kind() {
-		case "[":
-			brackOpenNode = ch
-		case "]":
-			brackCloseNode = ch
+		case "=>":
+			f.writeString(" => ")
+		default:
+			f.formatNode(ch, indent)
 		}
 	}
-	isMultiline := f.hasByteBetweenNodes('\n', brackOpenNode, brackCloseNode)
+}
 
+// formatCollection formats array, hash and named tuple literals, which are
+// only broken when they don't fit. Broken literals get a trailing comma.
+func (f *Formatter) formatCollection(node *sitter.Node, indent int) {
+	openNode := node.Child(0)
+	var closeNode *sitter.Node
+	var items []*sitter.Node
 	for ch := range eachChild(node) {
+		if closeNode != nil {
+			break
+		}
 		switch ch.Kind() {
-		case ",":
-			f.writeContent(ch)
-			if !isMultiline {
-				f.writeByte(' ')
-			}
-		case "[":
-			f.writeContent(ch)
-		case "]":
-			if isMultiline {
-				f.writeLF()
-				f.writeIndent(indent)
-			}
-			f.writeContent(ch)
+		case "]", "}":
+			closeNode = ch
+		case "[", "{", ",", "comment":
+		default:
+			items = append(items, ch)
+		}
+	}
+	// Comments need lines of their own
+	f.group(len(f.danglingComments(node)) > 0, func() {
+		f.writeContent(openNode)
+		if len(items) > 0 {
+			f.indent(func() {
+				f.softLine()
+				for idx, item := range items {
+					if f.isVerbatim(item) {
+						continue
+					}
+					if idx > 0 {
+						// Unless it was written along with a region turned off
+						if !f.isVerbatim(commaAfter(items[idx-1])) {
+							f.writeByte(',')
+						}
+						f.line()
+					}
+					f.formatNode(item, indent+f.indentSize)
+				}
+				// A comma after arguments without parentheses would be
+				// taken as one more argument
+				last := items[len(items)-1]
+				if !endsWithOpenArguments(last) && !f.isVerbatim(commaAfter(last)) {
+					f.ifBreak(func() {
+						f.writeByte(',')
+					}, func() {})
+				}
+				f.writeDanglingComments(node)
+			})
+			f.softLine()
+		} else if len(f.danglingComments(node)) > 0 {
+			f.indent(func() {
+				f.writeDanglingComments(node)
+			})
+			f.softLine()
+		}
+		f.writeContent(closeNode)
+	})
 
+	// Type of empty literals, as in [] of Int32 or {} of String => Int32
+	for ch := closeNode.NextSibling(); ch != nil; ch = ch.NextSibling() {
+		switch ch.Kind() {
+		case "of", "=>":
+			f.writeString(" %s ", f.getContent(ch))
 		default:
-			if isMultiline {
-				f.writeLF()
-				f.writeIndent(indent + f.indentSize)
-			}
+			f.formatNode(ch, indent)
+		}
+	}
+}
 
-			f.formatNode(ch, indent+f.indentSize)
+// commaAfter returns the comma separating node from the next item of a list,
+// if there is one
+func commaAfter(node *sitter.Node) *sitter.Node {
+	next := node.NextSibling()
+	for next != nil && next.Kind() == "comment" {
+		next = next.NextSibling()
+	}
+	if next == nil || next.Kind() != "," {
+		return nil
+	}
+	return next
+}
 
-			// Add trailing comma to multiline array
-			if next := ch.NextSibling(); next != nil && next.Kind() == "]" && isMultiline {
-				f.writeByte(',')
-			}
+// endsWithOpenArguments reports whether node ends with the arguments of a
+// call without parentheses, as in foo 1
+func endsWithOpenArguments(node *sitter.Node) bool {
+	for curr := node; curr != nil && curr.ChildCount() > 0; curr = curr.Child(curr.ChildCount() - 1) {
+		if curr.Kind() == "argument_list" && curr.Child(0).Kind() != "(" {
+			return true
 		}
 	}
+	return false
+}
+
+// formatAssignCall formats attribute targets like the obj.name in
+// obj.name = value
+func (f *Formatter) formatAssignCall(node *sitter.Node) {
+	for ch := range eachChild(node) {
+		f.formatNode(ch, 0)
+	}
 }
 
 func (f *Formatter) formatIndexCall(node *sitter.Node) {
@@ -687,18 +1799,6 @@ func (f *Formatter) formatSelf(node *sitter.Node) {
 	f.writeContent(node)
 }
 
-func (f *Formatter) formatTuple(node *sitter.Node) {
-	for ch := range eachChild(node) {
-		switch ch.Kind() {
-		case ",":
-			f.formatNode(ch, 0)
-			f.writeByte(' ')
-		default:
-			f.formatNode(ch, 0)
-		}
-	}
-}
-
 func (f *Formatter) workaroundNestedParens(node *sitter.Node) {
 	for ch := range eachChild(node) {
 		f.writeContent(ch)
@@ -733,8 +1833,26 @@ func (f *Formatter) formatNode(node *sitter.Node, indent int) {
 	// 	}
 	// }
 
+	// Attached comments are written along with the node they're attached to
+	if node.Kind() == "comment" && f.isAttachedComment[node.Id()] {
+		return
+	}
+	f.writeLeadingComments(node, indent)
+
+	if f.writeVerbatim(node) {
+		f.writeTrailingComments(node)
+		return
+	}
+
+	// Breaking its last line would move code into the body of the heredoc
+	if f.endsOnHeredocStartLine(node) {
+		f.writeRawContent(node)
+		f.writeTrailingComments(node)
+		return
+	}
+
 	switch node.Kind() {
-	case "class_def":
+	case "class_def", "struct_def", "module_def", "enum_def":
 		f.formatClass(node, indent)
 
 	case "method_def":
@@ -746,9 +1864,12 @@ func (f *Formatter) formatNode(node *sitter.Node, indent int) {
 	case "require":
 		f.formatRequire(node)
 
-	case "assign":
+	case "assign", "op_assign":
 		f.formatAssign(node, indent)
 
+	case "assign_call":
+		f.formatAssignCall(node)
+
 	case "call":
 		f.formatCall(node, indent)
 
@@ -762,21 +1883,42 @@ func (f *Formatter) formatNode(node *sitter.Node, indent int) {
 		f.formatBlock(node, indent)
 
 	case "block_argument":
-		f.formatBlockArgument(node)
+		f.formatBlockArgument(node, indent)
+
+	case "proc":
+		f.formatProc(node, indent)
 
-	case "string":
+	case "method_proc":
+		f.formatMethodProc(node)
+
+	case "string", "regex", "command":
 		f.formatString(node)
 
+	case "char":
+		f.formatChar(node)
+
 	case "array":
 		f.formatArray(node, indent)
 
+	case "hash", "named_tuple":
+		f.formatHash(node, indent)
+
+	case "hash_entry":
+		f.formatHashEntry(node, indent)
+
 	case "index_call":
 		f.formatIndexCall(node)
 
-	case "integer", "float":
+	case "heredoc_start":
+		f.formatHeredocStart(node)
+
+	case "heredoc_body":
+		f.formatHeredocBody(node)
+
+	case "integer", "float", "nil", "true", "false":
 		f.formatLiteral(node)
 
-	case "identifier":
+	case "identifier", "instance_var", "class_var":
 		f.formatIdentifier(node)
 
 	case "comment":
@@ -797,6 +1939,15 @@ func (f *Formatter) formatNode(node *sitter.Node, indent int) {
 	case "operator":
 		f.formatOperator(node)
 
+	case "range":
+		f.formatRange(node, indent)
+
+	case "and", "or":
+		f.formatBinary(node, indent)
+
+	case "not":
+		f.formatNot(node, indent)
+
 	case "constant":
 		f.formatConstant(node)
 
@@ -813,48 +1964,140 @@ func (f *Formatter) formatNode(node *sitter.Node, indent int) {
 		f.formatSelf(node)
 
 	case "tuple":
-		f.formatTuple(node)
+		f.formatCollection(node, indent)
 
 	case "implicit_object_call":
 		f.formatImplicitObjectCall(node)
 
-	case "splat":
+	case "param":
+		f.formatParam(node)
+
+	case "block_param":
+		f.formatBlockParam(node)
+
+	case "splat", "splat_param", "double_splat", "double_splat_param":
 		f.formatSplatParam(node)
 
-	case "(", ")", "[", "]", "{", "}", ",", ".", "break", "&":
+	case "case":
+		f.formatCase(node, indent)
+
+	case "when":
+		f.formatWhen(node, indent)
+
+	case "named_expr":
+		f.formatNamedExpr(node)
+
+	case "(", ")", "[", "]", "{", "}", ",", ".", "break", "&", "->":
 		f.writeContent(node)
 
 	case "ERROR":
-		fmt.Println("--- got error:", f.getContent(node))
-		f.writeContent(node)
+		fmt.Fprintln(os.Stderr, "--- got error:", f.getContent(node))
+		f.writeRawContent(node)
 
 	default:
-		fmt.Println("--- caught:", node.Kind())
+		fmt.Fprintln(os.Stderr, "--- caught:", node.Kind())
+		f.unsupported = append(f.unsupported, unsupportedNode{kind: node.Kind(), offset: int(node.StartByte())})
 		// Fallback to just printing the raw source content for unknown types
-		f.writeContent(node)
+		f.writeRawContent(node)
 	}
+
+	f.writeTrailingComments(node)
+	f.writeRemainingDanglingComments(node)
 }
 
 func (f *Formatter) writeIndent(indent int) {
-	for range indent {
-		f.strBuilder.WriteByte(' ')
+	if indent > 0 {
+		f.write(textDoc(strings.Repeat(" ", indent)))
 	}
 }
 
 func (f *Formatter) writeContent(node *sitter.Node) {
-	f.strBuilder.WriteString(f.getContent(node))
+	f.write(textDoc(f.getContent(node)))
+}
+
+// writeRawContent writes node as it is in the source, comments included
+func (f *Formatter) writeRawContent(node *sitter.Node) {
+	f.writeContent(node)
+	f.markCommentsEmitted(node)
+}
+
+func (f *Formatter) markCommentsEmitted(node *sitter.Node) {
+	for ch := range eachChild(node) {
+		if ch.Kind() == "comment" {
+			f.emittedComments[ch.Id()] = true
+		}
+		f.markCommentsEmitted(ch)
+	}
 }
 
 func (f *Formatter) writeString(str string, a ...any) {
-	fmt.Fprintf(f.strBuilder, str, a...)
+	f.write(textDoc(fmt.Sprintf(str, a...)))
 }
 
 func (f *Formatter) writeByte(b byte) {
-	f.strBuilder.WriteByte(b)
+	f.write(textDoc(string(b)))
 }
 
 func (f *Formatter) writeLF() {
-	f.writeByte('\n')
+	f.write(hardLineDoc())
+}
+
+// write appends doc to the document being built
+func (f *Formatter) write(doc *Doc) {
+	curr := f.docStack[len(f.docStack)-1]
+	curr.children = append(curr.children, doc)
+}
+
+// build returns the document written by fn
+func (f *Formatter) build(fn func()) *Doc {
+	doc := concatDoc()
+	f.docStack = append(f.docStack, doc)
+	fn()
+	f.docStack = f.docStack[:len(f.docStack)-1]
+	return doc
+}
+
+// group writes what fn writes as a group, which is printed on one line if
+// it fits. Otherwise, its line breaks are broken. Groups starting a heredoc
+// whose body comes after them are never broken, since the body must start
+// on the line after the one where the heredoc starts.
+func (f *Formatter) group(shouldBreak bool, fn func()) {
+	pending := len(f.pendingHeredocs)
+	doc := f.build(fn)
+	if len(f.pendingHeredocs) > pending {
+		f.write(flatDoc(doc))
+		return
+	}
+	f.write(groupDoc(shouldBreak, doc))
+}
+
+// indent makes the line breaks written by fn one level deeper than the line
+// they start on
+func (f *Formatter) indent(fn func()) {
+	f.write(indentDoc(f.build(fn)))
+}
+
+// ifBreak writes what broken writes if the enclosing group is broken, or
+// what flat writes otherwise
+func (f *Formatter) ifBreak(broken func(), flat func()) {
+	f.write(ifBreakDoc([]*Doc{f.build(broken)}, []*Doc{f.build(flat)}))
+}
+
+// line writes a line break, or a space if the enclosing group isn't broken
+func (f *Formatter) line() {
+	f.write(lineDoc())
+}
+
+// softLine writes a line break, or nothing if the enclosing group isn't
+// broken
+func (f *Formatter) softLine() {
+	f.write(softLineDoc())
+}
+
+// sourceLineIndent returns the indentation of the source line where node starts
+func (f *Formatter) sourceLineIndent(node *sitter.Node) int {
+	lineStart := f.lineStartPositions[node.Range().StartPoint.Row]
+	return countIndent(f.source[lineStart:])
 }
 
 func (f *Formatter) getContent(node *sitter.Node) string {
@@ -880,6 +2123,15 @@ func eachChild(node *sitter.Node) iter.Seq2[*sitter.Node, uint] {
 	}
 }
 
+func childOfKind(node *sitter.Node, kind string) *sitter.Node {
+	for ch := range eachChild(node) {
+		if ch.Kind() == kind {
+			return ch
+		}
+	}
+	return nil
+}
+
 func eachChildByFieldName(node *sitter.Node, field string) iter.Seq2[*sitter.Node, uint] {
 	return func(yield func(*sitter.Node, uint) bool) {
 		for ch, idx := range eachChild(node) {
@@ -934,18 +2186,6 @@ func buildLineStartPositions(source []byte) []int {
 	return positions
 }
 
-func (f *Formatter) hasByteBetweenNodes(b byte, startNode *sitter.Node, endNode *sitter.Node) bool {
-	startPos := f.getNodeStartPosition(startNode)
-	endPos := f.getNodeEndPosition(endNode)
-	between := f.source[startPos:endPos]
-	for _, c := range between {
-		if c == b {
-			return true
-		}
-	}
-	return false
-}
-
 func hasTwoNewlines(b []byte) bool {
 	count := 0
 	for _, c := range b {
@@ -959,6 +2199,28 @@ func hasTwoNewlines(b []byte) bool {
 	return false
 }
 
+func countIndent(b []byte) int {
+	count := 0
+	for count < len(b) && (b[count] == ' ' || b[count] == '\t') {
+		count++
+	}
+	return count
+}
+
+// minLineIndent returns the smallest indentation among the non-blank lines of b
+func minLineIndent(b []byte) int {
+	minIndent := -1
+	for _, line := range strings.Split(string(b), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		if indent := countIndent([]byte(line)); minIndent == -1 || indent < minIndent {
+			minIndent = indent
+		}
+	}
+	return max(minIndent, 0)
+}
+
 func countLF(b []byte) int {
 	count := 0
 	for _, c := range b {
@@ -1,203 +1,1199 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"flag"
 	"fmt"
+	"io"
 	"os"
+	"os/exec"
 	"path/filepath"
+	"reflect"
+	"runtime"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	crystal "github.com/crystal-lang-tools/tree-sitter-crystal/bindings/go"
 	sitter "github.com/tree-sitter/go-tree-sitter"
 )
 
-func TestFormatter(t *testing.T) {
-	// Run all test cases in the testdata directory
-	err := filepath.Walk("testdata", func(path string, info os.FileInfo, err error) error {
+var update = flag.Bool("update", false, "rewrite the expected output of the golden tests")
+
+// A golden test case: testdata/<name>_input.cr is formatted and compared to
+// testdata/<name>_expected.cr. Input files can start with a header setting
+// the options of the case, like
+//
+//	# test-options: indent-size=2 line-width=40 align-comments wrap-comments lines=3:5,8:8
+//
+// which isn't part of the input.
+type goldenCase struct {
+	name         string
+	inputPath    string
+	expectedPath string
+	input        []byte
+
+	indentSize    int
+	lineWidth     int
+	alignComments bool
+	wrapComments  bool
+
+	// Lines to format, or nil to format all of them
+	lines []lineSpan
+}
+
+const testOptionsHeader = "# test-options:"
+
+func loadGoldenCases(t *testing.T) []goldenCase {
+	inputPaths, err := filepath.Glob("testdata/*_input.cr")
+	if err != nil {
+		t.Fatalf("Error listing test files: %v", err)
+	}
+
+	var cases []goldenCase
+	for _, inputPath := range inputPaths {
+		input, err := os.ReadFile(inputPath)
 		if err != nil {
-			return err
+			t.Fatalf("Failed to read input file %s: %v", inputPath, err)
 		}
 
-		// Only process input files
-		if !info.IsDir() && strings.HasSuffix(path, "_input.cr") {
-			basePath := strings.TrimSuffix(path, "_input.cr")
-			expectedPath := basePath + "_expected.cr"
+		basePath := strings.TrimSuffix(inputPath, "_input.cr")
+		c := goldenCase{
+			name:         filepath.Base(basePath),
+			inputPath:    inputPath,
+			expectedPath: basePath + "_expected.cr",
+			input:        input,
+			indentSize:   4,
+			lineWidth:    80,
+		}
 
-			// Run this specific test case
-			runFormatTest(t, path, expectedPath)
+		for bytes.HasPrefix(c.input, []byte(testOptionsHeader)) {
+			header, rest, _ := bytes.Cut(c.input, []byte("\n"))
+			c.input = rest
+			options := strings.TrimPrefix(string(header), testOptionsHeader)
+			if err := c.setOptions(strings.Fields(options)); err != nil {
+				t.Fatalf("%s: %v", inputPath, err)
+			}
 		}
 
-		return nil
-	})
+		cases = append(cases, c)
+	}
+	return cases
+}
 
+func (c *goldenCase) setOptions(options []string) error {
+	for _, option := range options {
+		name, value, _ := strings.Cut(option, "=")
+		switch name {
+		case "indent-size", "line-width":
+			n, err := strconv.Atoi(value)
+			if err != nil || n <= 0 {
+				return fmt.Errorf("invalid %s: %q", name, value)
+			}
+			if name == "indent-size" {
+				c.indentSize = n
+			} else {
+				c.lineWidth = n
+			}
+		case "align-comments":
+			c.alignComments = true
+		case "wrap-comments":
+			c.wrapComments = true
+		case "lines":
+			for _, span := range strings.Split(value, ",") {
+				first, last, _ := strings.Cut(span, ":")
+				firstLine, err := strconv.Atoi(first)
+				lastLine, lastErr := strconv.Atoi(last)
+				if err != nil || lastErr != nil {
+					return fmt.Errorf("invalid lines: %q", value)
+				}
+				c.lines = append(c.lines, lineSpan{first: firstLine, last: lastLine})
+			}
+		default:
+			return fmt.Errorf("unknown test option: %s", option)
+		}
+	}
+	return nil
+}
+
+// format formats source with the options of the case
+func (c goldenCase) format(t *testing.T, source []byte) (string, *Formatter) {
+	tree := parseSource(t, source)
+	f := newFormatter(source, c.indentSize, c.lineWidth)
+	f.alignComments = c.alignComments
+	f.wrapComments = c.wrapComments
+	for _, span := range c.lines {
+		if err := f.selectLines(span.first, span.last); err != nil {
+			t.Fatalf("%s: %v", c.inputPath, err)
+		}
+	}
+	return f.format(tree.RootNode()), f
+}
+
+func newTestParser(t testing.TB) *sitter.Parser {
+	parser := sitter.NewParser()
+	err := parser.SetLanguage(sitter.NewLanguage(crystal.Language()))
 	if err != nil {
-		t.Fatalf("Error walking test files: %v", err)
+		t.Fatalf("Failed to set language: %v", err)
 	}
+	return parser
 }
 
-func runFormatTest(t *testing.T, inputPath, expectedPath string) {
-	// Extract test name for better error reporting
-	testName := filepath.Base(strings.TrimSuffix(inputPath, "_input.cr"))
+func parseSource(t *testing.T, source []byte) *sitter.Tree {
+	return newTestParser(t).Parse(source, nil)
+}
 
-	// Create a subtest for each test case
-	t.Run(testName, func(t *testing.T) {
-		// Read input file
-		input, err := os.ReadFile(inputPath)
-		if err != nil {
-			t.Fatalf("Failed to read input file %s: %v", inputPath, err)
+// TestFormatter formats every golden test case, and makes sure that
+// formatting the result again changes nothing. Run with -update to rewrite
+// the expected output.
+func TestFormatter(t *testing.T) {
+	for _, c := range loadGoldenCases(t) {
+		t.Run(c.name, func(t *testing.T) {
+			got, f := c.format(t, c.input)
+			if f.err != nil {
+				t.Fatalf("Unable to format: %v", f.err)
+			}
+
+			if *update {
+				err := os.WriteFile(c.expectedPath, []byte(got+"\n"), 0644)
+				if err != nil {
+					t.Fatalf("Failed to write expected file %s: %v", c.expectedPath, err)
+				}
+			}
+
+			expected, err := os.ReadFile(c.expectedPath)
+			if err != nil {
+				t.Fatalf("Failed to read expected file %s: %v", c.expectedPath, err)
+			}
+			want := strings.TrimSuffix(string(expected), "\n")
+			if got != want {
+				t.Errorf("Formatting mismatch:\n%s", unifiedDiff(c.expectedPath, "got", want, got))
+			}
+
+			again, _ := c.format(t, []byte(got))
+			if again != got {
+				t.Errorf("Formatting is not idempotent:\n%s", unifiedDiff("once", "twice", got, again))
+			}
+		})
+	}
+}
+
+// TestCommentsArePreserved checks that every comment of every test case is
+// in the formatted output, in the same order
+func TestCommentsArePreserved(t *testing.T) {
+	for _, c := range loadGoldenCases(t) {
+		tree := parseSource(t, c.input)
+		got, f := c.format(t, c.input)
+		if f.err != nil {
+			t.Errorf("%s: Unable to format: %v", c.inputPath, f.err)
+			continue
 		}
 
-		// Read expected output file
-		expected, err := os.ReadFile(expectedPath)
-		if err != nil {
-			t.Fatalf("Failed to read expected file %s: %v", expectedPath, err)
+		checkCommentsKept(t, c, collectComments(tree.RootNode(), c.input), got)
+	}
+}
+
+func checkCommentsKept(t *testing.T, c goldenCase, comments []string, got string) {
+	rest := got
+	for _, cmt := range comments {
+		// Wrapped comments only keep their words
+		if c.wrapComments {
+			for _, word := range strings.Fields(strings.TrimPrefix(cmt, "#")) {
+				idx := strings.Index(rest, word)
+				if idx == -1 {
+					t.Errorf("%s: Comment was lost or moved out of order: %q", c.inputPath, cmt)
+					return
+				}
+				rest = rest[idx+len(word):]
+			}
+			continue
 		}
 
-		// Set up Tree-sitter parser
-		lang := sitter.NewLanguage(crystal.Language())
-		if lang == nil {
-			panic("Unable to load crystal")
+		// Comments in code fences of doc comments aren't normalized
+		written := normalizeComment(cmt)
+		idx := strings.Index(rest, written)
+		if idx == -1 {
+			written = cmt
+			idx = strings.Index(rest, written)
 		}
-		parser := sitter.NewParser()
-		err = parser.SetLanguage(lang)
-		if err != nil {
-			fmt.Println("--- failed to set language:", err)
+		if idx == -1 {
+			t.Errorf("%s: Comment was lost or moved out of order: %q", c.inputPath, cmt)
+			return
 		}
+		rest = rest[idx+len(written):]
+	}
+}
 
-		tree := parser.Parse(input, nil)
+func TestUnclosedDirectiveWarns(t *testing.T) {
+	input := []byte(`def foo
+  # crystalfmt:off
+  a   =  1
+end
+b   =  2
+`)
+	want := `def foo
+    # crystalfmt:off
+    a   =  1
+end
+
+b = 2`
+
+	tree := parseSource(t, input)
+	f := newFormatter(input, 4, 80)
+	if got := f.format(tree.RootNode()); got != want {
+		t.Errorf("Formatting mismatch:\n%s", unifiedDiff("want", "got", want, got))
+	}
+	if len(f.warnings) != 1 || !strings.Contains(f.warnings[0], "line 2") {
+		t.Errorf("Expected a warning about line 2, got %v", f.warnings)
+	}
+}
 
-		f := Formatter{
-			strBuilder:         &strings.Builder{},
-			source:             input,
-			lineStartPositions: buildLineStartPositions(input),
-			indentSize:         4,
+// TestVerify checks that formatting every golden test case keeps its syntax
+// tree
+func TestVerify(t *testing.T) {
+	parser := newTestParser(t)
+	for _, c := range loadGoldenCases(t) {
+		tree := parser.Parse(c.input, nil)
+		got, f := c.format(t, c.input)
+		if err := f.verify(parser, tree, got); err != nil {
+			t.Errorf("%s: %v", c.inputPath, err)
 		}
+	}
+}
+
+func TestVerifyCatchesChanges(t *testing.T) {
+	tests := []struct {
+		input     string
+		formatted string
+		want      string
+	}{
+		{"foo(a, b)", "foo(a)", `"," at line 1, column 6 became ) ")"`},
+		{"x = 1", "x = 2", `integer "1" at line 1, column 5 became integer "2"`},
+		{"[1, 2,]", "[1, 2]", ""},
+		{"x = 1 # one", "x = 1\n", "not idempotent"},
+	}
 
-		f.formatNode(tree.RootNode(), 0)
+	parser := newTestParser(t)
+	for _, tt := range tests {
+		tree := parser.Parse([]byte(tt.input), nil)
+		f := newFormatter([]byte(tt.input), 4, 80)
+		err := f.verify(parser, tree, tt.formatted)
+		switch {
+		case tt.want == "" && err != nil:
+			t.Errorf("%q: unexpected error: %v", tt.input, err)
+		case tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)):
+			t.Errorf("%q: expected an error containing %q, got %v", tt.input, tt.want, err)
+		}
+	}
+}
 
-		got := f.strBuilder.String()
-		want := strings.TrimSuffix(string(expected), "\n")
+func TestFormatSelection(t *testing.T) {
+	input := "x   =  1\r\ndef foo\n  a   =  [1,2]   # two\n  b=3\nend  \n"
+	tests := []struct {
+		offset int
+		length int
+		want   string
+	}{
+		// Only the statement at the offset
+		{27, 0, "x   =  1\r\ndef foo\n  a = [1, 2] # two\n  b=3\nend  \n"},
+		// Both statements of the body
+		{20, 26, "x   =  1\r\ndef foo\n  a = [1, 2] # two\n  b = 3\nend  \n"},
+		// The smallest statement enclosing the selection
+		{16, 20, "x   =  1\r\ndef foo\n    a = [1, 2] # two\n    b = 3\nend  \n"},
+		// Nothing but whitespace
+		{8, 2, input},
+	}
 
-		// Compare results
-		if got != want {
-			diff := generateDiff(want, got)
-			t.Errorf("%s: Formatting mismatch: %s", testName, diff)
-		} else {
-			fmt.Println(testName+":", "pass")
+	for _, tt := range tests {
+		source := []byte(input)
+		tree := parseSource(t, source)
+		f := newFormatter(source, 4, 80)
+		if err := f.selectBytes(tt.offset, tt.length); err != nil {
+			t.Fatal(err)
 		}
-	})
+		got := f.format(tree.RootNode())
+		if got != tt.want {
+			t.Errorf("%d bytes at %d:\n%s", tt.length, tt.offset, unifiedDiff("want", "got", tt.want, got))
+		}
+	}
 }
 
-func generateDiff(want, got string) string {
-	var diff strings.Builder
+func TestParseDiff(t *testing.T) {
+	diff := `diff --git a/src/point.cr b/src/point.cr
+index 3b18e51..a9d3c2f 100644
+--- a/src/point.cr
++++ b/src/point.cr
+@@ -3 +3,2 @@ class Point
+-  def x
++  def x : Int32
++    @x
+@@ -10,2 +11,0 @@ class Point
+-  end
+-end
+@@ -20 +19 @@ end
+-puts 1
++puts 2
+diff --git a/README.md b/README.md
+--- a/README.md
++++ b/README.md
+@@ -1 +1 @@
+-# crystalfmt
++# Crystalfmt
+diff --git a/old.cr b/old.cr
+deleted file mode 100644
+--- a/old.cr
++++ /dev/null
+@@ -1 +0,0 @@
+-x = 1
+diff --git "a/with space.cr" "b/with space.cr"
+--- "a/with space.cr"
++++ "b/with space.cr"
+@@ -0,0 +1,3 @@
++a = 1
++b = 2
++c = 3
+`
+	got, err := parseDiff([]byte(diff))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string][]lineSpan{
+		"src/point.cr":  {{first: 3, last: 4}, {first: 19, last: 19}},
+		"with space.cr": {{first: 1, last: 3}},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v, got %v", want, got)
+	}
+}
 
-	// First compare lengths
-	diff.WriteString(fmt.Sprintf("Lengths: want=%d got=%d\n", len(want), len(got)))
+func TestDiffEdits(t *testing.T) {
+	tests := []struct {
+		text      string
+		formatted string
+		want      []edit
+	}{
+		{"a = 1\n", "a = 1\n", nil},
+		{
+			"x   =  1\n",
+			"x = 1\n",
+			[]edit{{
+				Start:   editPosition{Offset: 2, Line: 1, Column: 3, UTF16Column: 3},
+				End:     editPosition{Offset: 6, Line: 1, Column: 7, UTF16Column: 7},
+				NewText: "=",
+			}},
+		},
+		{
+			"s = \"😀\"  # é\n",
+			"s = \"😀\" # é\n",
+			[]edit{{
+				Start:   editPosition{Offset: 11, Line: 1, Column: 12, UTF16Column: 10},
+				End:     editPosition{Offset: 12, Line: 1, Column: 13, UTF16Column: 11},
+				NewText: "",
+			}},
+		},
+		{
+			"a\nb\nc\n",
+			"a\n\nc",
+			[]edit{
+				{
+					Start:   editPosition{Offset: 2, Line: 2, Column: 1, UTF16Column: 1},
+					End:     editPosition{Offset: 3, Line: 2, Column: 2, UTF16Column: 2},
+					NewText: "",
+				},
+				{
+					Start:   editPosition{Offset: 5, Line: 3, Column: 2, UTF16Column: 2},
+					End:     editPosition{Offset: 6, Line: 4, Column: 1, UTF16Column: 1},
+					NewText: "",
+				},
+			},
+		},
+	}
 
-	// Find first difference
-	minLen := min(len(got), len(want))
+	for _, tt := range tests {
+		got := diffEdits([]byte(tt.text), []byte(tt.formatted))
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q to %q: expected %+v, got %+v", tt.text, tt.formatted, tt.want, got)
+		}
+	}
+}
+
+// TestDiffEditsApply checks that applying the edits between the input and
+// the expected output of every golden test case gives the expected output
+func TestDiffEditsApply(t *testing.T) {
+	for _, c := range loadGoldenCases(t) {
+		expected, err := os.ReadFile(c.expectedPath)
+		if err != nil {
+			t.Fatalf("Failed to read expected file %s: %v", c.expectedPath, err)
+		}
 
-	firstDiffPos := -1
-	for i := range minLen {
-		if want[i] != got[i] {
-			firstDiffPos = i
-			break
+		edits := diffEdits(c.input, expected)
+		got := applyEdits(c.input, edits)
+		if got != string(expected) {
+			t.Errorf("%s: Edits don't give the expected output:\n%s",
+				c.inputPath, unifiedDiff(c.expectedPath, "got", string(expected), got))
+		}
+		for idx := 1; idx < len(edits); idx++ {
+			if edits[idx].Start.Offset < edits[idx-1].End.Offset {
+				t.Errorf("%s: Edits %d and %d overlap", c.inputPath, idx, idx+1)
+			}
 		}
 	}
+}
 
-	if firstDiffPos != -1 {
-		// Show the context around the first difference
-		startPos := max(0, firstDiffPos-20)
-		endPosWant := min(len(want), firstDiffPos+20)
-		endPosGot := min(len(got), firstDiffPos+20)
+func applyEdits(text []byte, edits []edit) string {
+	var sb strings.Builder
+	pos := 0
+	for _, e := range edits {
+		sb.Write(text[pos:e.Start.Offset])
+		sb.WriteString(e.NewText)
+		pos = e.End.Offset
+	}
+	sb.Write(text[pos:])
+	return sb.String()
+}
 
-		diff.WriteString(fmt.Sprintf("First difference at position %d:\n", firstDiffPos))
+// TestDiffHunks checks the hunks of the unified diffs in reports
+func TestDiffHunks(t *testing.T) {
+	text := "a\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nl\n"
+	formatted := "A\nb\nc\nd\ne\nf\ng\nh\ni\nj\nk\nL"
+	hunks := diffHunks([]byte(text), []byte(formatted))
+	expected := []hunk{
+		{OldStart: 1, OldLines: 4, NewStart: 1, NewLines: 4, Diff: "@@ -1,4 +1,4 @@\n-a\n+A\n b\n c\n d\n"},
+		{OldStart: 9, OldLines: 4, NewStart: 9, NewLines: 4,
+			Diff: "@@ -9,4 +9,4 @@\n i\n j\n k\n-l\n+L\n\\ No newline at end of file\n"},
+	}
+	if !reflect.DeepEqual(hunks, expected) {
+		t.Errorf("Expected %#v, got %#v", expected, hunks)
+	}
 
-		// Show hex values of differing bytes
-		diff.WriteString(fmt.Sprintf("want[%d]=0x%02x (%q), got[%d]=0x%02x (%q)\n",
-			firstDiffPos, want[firstDiffPos], string(want[firstDiffPos]),
-			firstDiffPos, got[firstDiffPos], string(got[firstDiffPos])))
+	// Changes close to each other share a hunk, and lines only added start
+	// after the line before them
+	hunks = diffHunks([]byte("a\nb\nc\n"), []byte("a\nb\nx\nc\nd\n"))
+	if len(hunks) != 1 || hunks[0].Diff != "@@ -1,3 +1,5 @@\n a\n b\n+x\n c\n+d\n" {
+		t.Errorf("Expected one hunk, got %#v", hunks)
+	}
+	hunks = diffHunks(nil, []byte("a\n"))
+	if len(hunks) != 1 || hunks[0].Diff != "@@ -0,0 +1 @@\n+a\n" {
+		t.Errorf("Expected a hunk adding a line, got %#v", hunks)
+	}
+}
 
-		// Show context
-		diff.WriteString("Context:\n")
-		diff.WriteString("want: ")
-		for i := startPos; i < endPosWant; i++ {
-			if i == firstDiffPos {
-				diff.WriteString("[" + formatChar(want[i]) + "]")
-			} else {
-				diff.WriteString(formatChar(want[i]))
+func TestReport(t *testing.T) {
+	parser := newTestParser(t)
+	report := func(name, source string) fileReport {
+		tree := parser.Parse([]byte(source), nil)
+		defer tree.Close()
+		f := newFormatter([]byte(source), INDENT_SIZE, LINE_WIDTH)
+		formatted := f.format(tree.RootNode())
+		return newFileReport(name, []byte(source), tree.RootNode(), f, formatted)
+	}
+
+	reports := []fileReport{
+		report("formatted.cr", "puts   1\nFOO = 1\n"),
+		report("unchanged.cr", "puts 1"),
+		report("broken.cr", "puts 1\ndef (\n"),
+	}
+	statuses := []string{reports[0].Status, reports[1].Status, reports[2].Status}
+	if !slices.Equal(statuses, []string{statusFormatted, statusUnchanged, statusError}) {
+		t.Errorf("Unexpected statuses: %v", statuses)
+	}
+	if len(reports[0].Hunks) != 1 || !strings.Contains(reports[0].Hunks[0].Diff, "+puts 1\n") {
+		t.Errorf("Expected a hunk formatting the first line, got %#v", reports[0].Hunks)
+	}
+	nodes := reports[0].UnsupportedNodes
+	if len(nodes) != 1 || nodes[0].Kind != "const_assign" || nodes[0].Position.Line != 2 {
+		t.Errorf("Expected the constant on line 2 to be unsupported, got %#v", nodes)
+	}
+	if errs := reports[2].SyntaxErrors; len(errs) == 0 || errs[0].Position.Line != 2 {
+		t.Errorf("Expected a syntax error on line 2, got %#v", errs)
+	}
+
+	var out bytes.Buffer
+	if err := printReport(&out, reportJSON, reports, false); err != nil {
+		t.Fatal(err)
+	}
+	var decoded struct{ Files []fileReport }
+	if err := json.Unmarshal(out.Bytes(), &decoded); err != nil || !reflect.DeepEqual(decoded.Files, reports) {
+		t.Errorf("Expected the JSON report to hold the reports, got %s (%v)", out.String(), err)
+	}
+
+	out.Reset()
+	if err := printReport(&out, reportSARIF, reports, false); err != nil {
+		t.Fatal(err)
+	}
+	var sarif struct {
+		Version string
+		Runs    []struct {
+			Results []struct {
+				RuleID    string
+				Level     string
+				Locations []struct {
+					PhysicalLocation struct {
+						ArtifactLocation struct{ URI string }
+						Region           struct{ StartLine int }
+					}
+				}
 			}
 		}
-		diff.WriteString("\n")
+	}
+	if err := json.Unmarshal(out.Bytes(), &sarif); err != nil || sarif.Version != "2.1.0" || len(sarif.Runs) != 1 {
+		t.Fatalf("Expected a SARIF log, got %s (%v)", out.String(), err)
+	}
+	var results []string
+	for _, r := range sarif.Runs[0].Results {
+		loc := r.Locations[0].PhysicalLocation
+		results = append(results, fmt.Sprintf("%s:%d %s %s", loc.ArtifactLocation.URI, loc.Region.StartLine, r.Level, r.RuleID))
+	}
+	expected := []string{
+		"formatted.cr:2 note unsupported-node",
+		"formatted.cr:1 warning formatting",
+		"broken.cr:2 error syntax-error",
+	}
+	if !slices.Equal(results, expected) {
+		t.Errorf("Expected SARIF results %v, got %v", expected, results)
+	}
 
-		diff.WriteString("got:  ")
-		for i := startPos; i < endPosGot; i++ {
-			if i == firstDiffPos {
-				diff.WriteString("[" + formatChar(got[i]) + "]")
-			} else {
-				diff.WriteString(formatChar(got[i]))
+	out.Reset()
+	if err := printReport(&out, reportCheckstyle, reports, true); err != nil {
+		t.Fatal(err)
+	}
+	var checkstyle struct {
+		Files []struct {
+			Name   string `xml:"name,attr"`
+			Errors []struct {
+				Line     int    `xml:"line,attr"`
+				Severity string `xml:"severity,attr"`
+				Source   string `xml:"source,attr"`
+			} `xml:"error"`
+		} `xml:"file"`
+	}
+	if err := xml.Unmarshal(out.Bytes(), &checkstyle); err != nil || len(checkstyle.Files) != 3 {
+		t.Fatalf("Expected a Checkstyle report of 3 files, got %s (%v)", out.String(), err)
+	}
+	if errs := checkstyle.Files[0].Errors; len(errs) != 2 || errs[1].Severity != "info" || errs[1].Source != "crystalfmt.formatting" {
+		t.Errorf("Expected written files to be reported as info, got %#v", errs)
+	}
+}
+
+// TestDocumentEdits checks that reparsing a document after each change gives
+// the same tree as parsing it from scratch
+func TestDocumentEdits(t *testing.T) {
+	parser := newTestParser(t)
+	doc := newDocument(parser, []byte("def foo\n  a = 1\nend\n"))
+	defer doc.close()
+
+	changes := []struct {
+		start   int
+		end     int
+		newText string
+	}{
+		{10, 11, "b"},
+		{16, 16, "\n  c = [1, 2]"},
+		{0, 0, "# 😀\n"},
+		{8, 20, ""},
+		{0, 0, "class Foo\n"},
+	}
+	for _, change := range changes {
+		doc.edit(change.start, change.end, []byte(change.newText))
+		checkDocumentTree(t, parser, doc)
+	}
+
+	doc.replace([]byte("class Foo\n  def bar\n  end\nend\n"))
+	checkDocumentTree(t, parser, doc)
+}
+
+func checkDocumentTree(t *testing.T, parser *sitter.Parser, doc *document) {
+	t.Helper()
+	tree := parser.Parse(doc.text, nil)
+	defer tree.Close()
+
+	want := describeTree(tree.RootNode())
+	if got := describeTree(doc.tree.RootNode()); got != want {
+		t.Errorf("After changing the text to %q:\nwant %s\n got %s", doc.text, want, got)
+	}
+}
+
+// describeTree returns the kinds and positions of the nodes of a tree
+func describeTree(node *sitter.Node) string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "(%s %d-%d %v-%v", node.Kind(), node.StartByte(), node.EndByte(),
+		node.StartPosition(), node.EndPosition())
+	for ch := range eachChild(node) {
+		sb.WriteString(" ")
+		sb.WriteString(describeTree(ch))
+	}
+	sb.WriteString(")")
+	return sb.String()
+}
+
+// largeSource returns a source of several thousand lines, made of the inputs
+// of the golden test cases
+func largeSource(b *testing.B) []byte {
+	var source []byte
+	inputs, err := filepath.Glob("testdata/*_input.cr")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for bytes.Count(source, []byte("\n")) < 5000 {
+		for _, path := range inputs {
+			input, err := os.ReadFile(path)
+			if err != nil {
+				b.Fatal(err)
 			}
+			source = append(source, input...)
 		}
-		diff.WriteString("\n")
-	} else if len(want) != len(got) {
-		// If no character differences were found but lengths differ
-		diff.WriteString("No character differences found in the common portion, but lengths differ.\n")
+	}
+	return source
+}
 
-		if len(want) > len(got) {
-			diff.WriteString("want has additional characters: ")
-			for i := len(got); i < min(len(got)+40, len(want)); i++ {
-				diff.WriteString(formatChar(want[i]))
-			}
-			if len(want) > len(got)+40 {
-				diff.WriteString("...")
-			}
-		} else {
-			diff.WriteString("got has additional characters: ")
-			for i := len(want); i < min(len(want)+40, len(got)); i++ {
-				diff.WriteString(formatChar(got[i]))
-			}
-			if len(got) > len(want)+40 {
-				diff.WriteString("...")
-			}
+// BenchmarkReparse parses a large source from scratch after changing a line
+// in its middle. Compare with BenchmarkReparseIncremental.
+func BenchmarkReparse(b *testing.B) {
+	source := largeSource(b)
+	parser := newTestParser(b)
+	middle := bytes.IndexByte(source[len(source)/2:], '\n') + len(source)/2 + 1
+	source = slices.Concat(source[:middle], []byte("x = 0\n"), source[middle:])
+
+	b.ResetTimer()
+	for idx := range b.N {
+		source = slices.Concat(source[:middle], []byte(fmt.Sprintf("x = %d\n", idx%10)), source[middle+6:])
+		parser.Parse(source, nil).Close()
+	}
+}
+
+// BenchmarkReparseIncremental makes the same changes as BenchmarkReparse to
+// a document, which reparses only what they affect
+func BenchmarkReparseIncremental(b *testing.B) {
+	source := largeSource(b)
+	parser := newTestParser(b)
+	middle := bytes.IndexByte(source[len(source)/2:], '\n') + len(source)/2 + 1
+	doc := newDocument(parser, source)
+	defer doc.close()
+	doc.edit(middle, middle, []byte("x = 0\n"))
+
+	b.ResetTimer()
+	for idx := range b.N {
+		doc.edit(middle, middle+6, []byte(fmt.Sprintf("x = %d\n", idx%10)))
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "script.cr")
+	if err := os.WriteFile(path, []byte("puts   1\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	link := filepath.Join(dir, "link.cr")
+	if err := os.Symlink("script.cr", link); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := writeFileAtomic(link, []byte("puts 1\n"))
+	if err != nil || !changed {
+		t.Fatalf("Expected the file to change, got %v, %v", changed, err)
+	}
+	if got, _ := os.ReadFile(path); string(got) != "puts 1\n" {
+		t.Errorf("Expected the file the link points to to be written, got %q", got)
+	}
+	if info, err := os.Lstat(link); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Errorf("Expected the link to stay a link")
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0755 {
+		t.Errorf("Expected the file to keep its mode, got %v", info.Mode())
+	}
+
+	// Writing what the file already holds leaves it alone
+	old := time.Now().Add(-time.Hour).Truncate(time.Second)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+	changed, err = writeFileAtomic(path, []byte("puts 1\n"))
+	if err != nil || changed {
+		t.Fatalf("Expected the file not to change, got %v, %v", changed, err)
+	}
+	if info, _ := os.Stat(path); !info.ModTime().Equal(old) {
+		t.Errorf("Expected the modification time to stay %v, got %v", old, info.ModTime())
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 {
+		t.Errorf("Expected no temporary file to be left, got %v", entries)
+	}
+
+	if _, err := writeFileAtomic(dir, []byte("puts 1\n")); err == nil {
+		t.Errorf("Expected writing a directory to fail")
+	}
+}
+
+func TestCache(t *testing.T) {
+	t.Setenv("XDG_CACHE_HOME", t.TempDir())
+	t.Setenv(cacheEnvVar, "")
+
+	opts, err := parseArgs([]string{"--cache", "script.cr"})
+	if err != nil || !opts.useCache {
+		t.Fatalf("Expected --cache to turn the cache on, got %v, %v", opts.useCache, err)
+	}
+	cache, err := openCache(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := []byte("puts 1\n")
+	if cache.isFormatted(source) {
+		t.Fatalf("Expected an empty cache")
+	}
+	cache.markFormatted(source)
+	if !cache.isFormatted(source) {
+		t.Errorf("Expected the source to be known as formatted")
+	}
+	if cache.isFormatted([]byte("puts 2\n")) {
+		t.Errorf("Expected another source not to be known")
+	}
+
+	// Other options may format the same source differently
+	opts.lineWidth = 40
+	other, err := openCache(opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.isFormatted(source) {
+		t.Errorf("Expected the source not to be known with another line width")
+	}
+
+	if _, err := cleanCache(); err != nil {
+		t.Fatal(err)
+	}
+	if cache.isFormatted(source) {
+		t.Errorf("Expected cleaning the cache to forget the source")
+	}
+
+	t.Setenv(cacheEnvVar, "1")
+	for _, args := range [][]string{
+		{"--no-cache", "script.cr"},
+		{"--lines", "1:2", "script.cr"},
+	} {
+		opts, err := parseArgs(args)
+		if err != nil || opts.useCache {
+			t.Errorf("Expected %v not to use the cache, got %v, %v", args, opts.useCache, err)
 		}
-		diff.WriteString("\n")
-	} else {
-		// If we get here, the strings are identical
-		diff.WriteString("Strings are identical by character comparison, but Go reports they are different.\n")
-		diff.WriteString("This might indicate a Unicode normalization issue.\n")
+	}
+	if opts, _ := parseArgs([]string{"script.cr"}); !opts.useCache {
+		t.Errorf("Expected $%s to turn the cache on", cacheEnvVar)
+	}
+}
 
-		// Print the first few bytes of each string as hex
-		const sampleSize = 100
-		diff.WriteString(fmt.Sprintf("First %d bytes as hex:\n", min(sampleSize, len(want))))
-		diff.WriteString("want: ")
-		for i := range min(sampleSize, len(want)) {
-			diff.WriteString(fmt.Sprintf("%02x ", want[i]))
+func TestStaged(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git isn't installed")
+	}
+	dir := t.TempDir()
+	git := func(stdin string, args ...string) string {
+		t.Helper()
+		var input []byte
+		if stdin != "" {
+			input = []byte(stdin)
 		}
-		diff.WriteString("\ngot:  ")
-		for i := range min(sampleSize, len(got)) {
-			diff.WriteString(fmt.Sprintf("%02x ", got[i]))
+		out, err := runGit(dir, input, args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(out)
+	}
+	write := func(name, content string) {
+		t.Helper()
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
 		}
-		diff.WriteString("\n")
 	}
+	read := func(name string) string {
+		t.Helper()
+		content, err := os.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	git("", "init", "-q")
+
+	// Only the staged content is formatted, and changes left unstaged are
+	// kept in the working tree
+	write("a.cr", "puts   1\n")
+	write("b.cr", "puts   2\nputs 3\nputs 4\nputs 5\nputs 6\n")
+	git("", "add", "a.cr", "b.cr")
+	write("b.cr", "puts   2\nputs 3\nputs 4 # unstaged\nputs 5\nputs 6\n")
 
+	opts, err := parseArgs([]string{"--staged"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	parser := newTestParser(t)
+	var log bytes.Buffer
+	if err := formatStaged(parser, dir, opts, &log); err != nil {
+		t.Fatal(err)
+	}
+	if got := git("", "show", ":a.cr"); got != "puts 1" {
+		t.Errorf("Expected a.cr to be formatted in the index, got %q", got)
+	}
+	if got := read("a.cr"); got != "puts 1" {
+		t.Errorf("Expected a.cr to be formatted in the working tree, got %q", got)
+	}
+	if got := git("", "show", ":b.cr"); got != "puts 2\nputs 3\nputs 4\nputs 5\nputs 6" {
+		t.Errorf("Expected b.cr to be formatted in the index, got %q", got)
+	}
+	if got := read("b.cr"); got != "puts 2\nputs 3\nputs 4 # unstaged\nputs 5\nputs 6" {
+		t.Errorf("Expected b.cr to keep its unstaged change, got %q", got)
+	}
+	if log.String() != "a.cr was formatted\nb.cr was formatted\n" {
+		t.Errorf("Unexpected log: %q", log.String())
+	}
+
+	// Unstaged changes next to the formatting can't be kept, and nothing is
+	// written then
+	write("c.cr", "puts   6\n")
+	git("", "add", "c.cr")
+	write("c.cr", "puts   6\nputs 7\n")
+	write("d.cr", "puts   8\n")
+	git("", "add", "d.cr")
+	err = formatStaged(parser, dir, opts, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "c.cr: formatting the staged content conflicts") {
+		t.Errorf("Expected a conflict with the unstaged changes, got %v", err)
+	}
+	if got := git("", "show", ":d.cr"); got != "puts   8\n" {
+		t.Errorf("Expected d.cr to be left alone, got %q", got)
+	}
+	git("", "rm", "-q", "--cached", "-f", "c.cr")
+
+	// Commits of given paths use a temporary index, which formatting can't be
+	// written back from
+	index, err := os.ReadFile(filepath.Join(dir, ".git", "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	write(".git/next-index-1.lock", string(index))
+	t.Setenv("GIT_INDEX_FILE", filepath.Join(dir, ".git", "next-index-1.lock"))
+	err = formatStaged(parser, dir, opts, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "d.cr needs formatting, which can't be written back when committing given paths") {
+		t.Errorf("Expected a commit of given paths to be refused, got %v", err)
+	}
+	// The own index is locked while committing all that is staged
+	t.Setenv("GIT_INDEX_FILE", filepath.Join(dir, ".git", "index.lock"))
+	if isTemporary, err := isTemporaryIndex(dir); err != nil || isTemporary {
+		t.Errorf("Expected the lock of the own index not to be temporary, got %v, %v", isTemporary, err)
+	}
+	os.Unsetenv("GIT_INDEX_FILE")
+
+	// Unmerged files must be resolved first
+	object := strings.TrimSpace(git("puts 9\n", "hash-object", "-w", "--stdin"))
+	git("100644 "+object+" 1\te.cr\n100644 "+object+" 2\te.cr\n", "update-index", "--index-info")
+	err = formatStaged(parser, dir, opts, io.Discard)
+	if err == nil || !strings.Contains(err.Error(), "e.cr has merge conflicts") {
+		t.Errorf("Expected e.cr to have conflicts, got %v", err)
+	}
+
+	if _, err := parseArgs([]string{"--staged", "a.cr"}); err == nil {
+		t.Errorf("Expected --staged with a file to fail")
+	}
+
+	hook, err := installHook(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if content, _ := os.ReadFile(hook); !strings.Contains(string(content), "\nexec crystalfmt --staged\n") {
+		t.Errorf("Expected the hook to run crystalfmt --staged from $PATH, got %q", content)
+	}
+	if _, err := installHook(dir); err != nil {
+		t.Errorf("Expected installing the hook again to work, got %v", err)
+	}
+	if err := os.WriteFile(hook, []byte("#!/bin/sh\nmake lint\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := installHook(dir); err == nil {
+		t.Errorf("Expected another pre-commit hook to be left alone")
+	}
+}
+
+// A buffer safe to write from another goroutine
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestWatch(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("watching files is only supported on Linux")
+	}
+
+	dir := t.TempDir()
+	var log syncBuffer
+	stop := make(chan struct{})
+	stopped := make(chan error)
+	opts, err := parseArgs([]string{"--watch", dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		stopped <- watch(newTestParser(t), dir, opts, &log, stop)
+	}()
+	waitFor(t, &log, "Watching")
+
+	// Files in directories added while watching are formatted too
+	if err := os.Mkdir(filepath.Join(dir, "src"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "src", "a.cr")
+	if err := os.WriteFile(path, []byte("x   =  1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, &log, path+": formatted")
+	broken := filepath.Join(dir, "b.cr")
+	if err := os.WriteFile(broken, []byte("def foo\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, &log, broken+":2:1: missing end")
+
+	close(stop)
+	if err := <-stopped; err != nil {
+		t.Fatal(err)
+	}
+
+	if got, _ := os.ReadFile(path); string(got) != "x = 1" {
+		t.Errorf("Expected the file to be formatted, got %q", got)
+	}
+	if got, _ := os.ReadFile(broken); string(got) != "def foo\n" {
+		t.Errorf("Expected the file with syntax errors to be left as is, got %q", got)
+	}
+	// Writing the formatted file doesn't format it again
+	if strings.Count(log.String(), path) != 1 {
+		t.Errorf("Expected a single line about %s, got:\n%s", path, log.String())
+	}
+}
+
+// waitFor waits until the log contains text
+func waitFor(t *testing.T, log *syncBuffer, text string) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		if strings.Contains(log.String(), text) {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected %q in the log, got:\n%s", text, log.String())
+}
+
+// lspSession sends messages to a language server, and returns the exit
+// code of the server and the messages it sent back
+func lspSession(t *testing.T, messages ...string) (int, []rpcMessage) {
+	var in, out bytes.Buffer
+	for _, msg := range messages {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(msg), msg)
+	}
+	code := newLSPServer(newTestParser(t), &out).serve(&in)
+
+	var replies []rpcMessage
+	reader := bufio.NewReader(&out)
+	for {
+		msg, err := readMessage(reader)
+		if err == io.EOF {
+			return code, replies
+		}
+		if err != nil {
+			t.Fatalf("Invalid message from the server: %v", err)
+		}
+		replies = append(replies, *msg)
+	}
+}
+
+func TestLSP(t *testing.T) {
+	code, replies := lspSession(t,
+		`{"jsonrpc":"2.0","id":1,"method":"initialize","params":{}}`,
+		`{"jsonrpc":"2.0","method":"initialized","params":{}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/didOpen","params":{"textDocument":{"uri":"file:///a.cr","text":"x   =  1\ndef foo\n  a=1\nen"}}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/didChange","params":{"textDocument":{"uri":"file:///a.cr"},"contentChanges":[{"range":{"start":{"line":3,"character":2},"end":{"line":3,"character":2}},"text":"d\n"}]}}`,
+		`{"jsonrpc":"2.0","id":2,"method":"textDocument/formatting","params":{"textDocument":{"uri":"file:///a.cr"}}}`,
+		`{"jsonrpc":"2.0","id":3,"method":"textDocument/rangeFormatting","params":{"textDocument":{"uri":"file:///a.cr"},"range":{"start":{"line":0,"character":0},"end":{"line":0,"character":8}}}}`,
+		`{"jsonrpc":"2.0","id":4,"method":"textDocument/onTypeFormatting","params":{"textDocument":{"uri":"file:///a.cr"},"position":{"line":3,"character":3},"ch":"d"}}`,
+		`{"jsonrpc":"2.0","id":5,"method":"workspace/symbol","params":{}}`,
+		`{"jsonrpc":"2.0","id":6,"method":"shutdown"}`,
+		`{"jsonrpc":"2.0","method":"exit"}`,
+	)
+	if code != 0 {
+		t.Errorf("Expected exit code 0, got %d", code)
+	}
+
+	want := []string{
+		`{"jsonrpc":"2.0","id":1,"result":{"capabilities":{"documentFormattingProvider":true,"documentOnTypeFormattingProvider":{"firstTriggerCharacter":"d","moreTriggerCharacter":["\n"]},"documentRangeFormattingProvider":true,"textDocumentSync":{"change":2,"openClose":true}},"serverInfo":{"name":"crystalfmt"}}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"diagnostics":[{"range":{"start":{"line":3,"character":2},"end":{"line":3,"character":2}},"severity":1,"source":"crystalfmt","message":"missing end"}],"uri":"file:///a.cr"}}`,
+		`{"jsonrpc":"2.0","method":"textDocument/publishDiagnostics","params":{"diagnostics":[],"uri":"file:///a.cr"}}`,
+		`{"jsonrpc":"2.0","id":2,"result":[{"range":{"start":{"line":0,"character":2},"end":{"line":0,"character":6}},"newText":"="},{"range":{"start":{"line":2,"character":2},"end":{"line":2,"character":4}},"newText":"  a = "}]}`,
+		`{"jsonrpc":"2.0","id":3,"result":[{"range":{"start":{"line":0,"character":2},"end":{"line":0,"character":6}},"newText":"="}]}`,
+		`{"jsonrpc":"2.0","id":4,"result":[{"range":{"start":{"line":2,"character":2},"end":{"line":2,"character":4}},"newText":"  a = "}]}`,
+		`{"jsonrpc":"2.0","id":5,"error":{"code":-32601,"message":"unknown method: workspace/symbol"}}`,
+		`{"jsonrpc":"2.0","id":6,"result":null}`,
+	}
+	if len(replies) != len(want) {
+		t.Fatalf("Expected %d messages, got %d", len(want), len(replies))
+	}
+	for idx, reply := range replies {
+		if got := string(mustMarshal(reply)); got != want[idx] {
+			t.Errorf("Message %d:\nwant %s\n got %s", idx+1, want[idx], got)
+		}
+	}
+}
+
+func TestLSPExitWithoutShutdown(t *testing.T) {
+	if code, _ := lspSession(t, `{"jsonrpc":"2.0","method":"exit"}`); code != 1 {
+		t.Errorf("Expected exit code 1, got %d", code)
+	}
+}
+
+func TestLSPPositions(t *testing.T) {
+	text := []byte("a = \"é😀\"\nb")
+	tests := []struct {
+		offset int
+		pos    lspPosition
+	}{
+		{0, lspPosition{0, 0}},
+		{5, lspPosition{0, 5}},
+		{7, lspPosition{0, 6}},
+		{11, lspPosition{0, 8}},
+		{13, lspPosition{1, 0}},
+		{14, lspPosition{1, 1}},
+	}
+	for _, tt := range tests {
+		if got := offsetToPosition(text, tt.offset); got != tt.pos {
+			t.Errorf("offsetToPosition(%d): expected %v, got %v", tt.offset, tt.pos, got)
+		}
+		if got := positionToOffset(text, tt.pos); got != tt.offset {
+			t.Errorf("positionToOffset(%v): expected %d, got %d", tt.pos, tt.offset, got)
+		}
+	}
+
+	// Positions past the end of a line or of the text
+	if got := positionToOffset(text, lspPosition{0, 40}); got != 12 {
+		t.Errorf("Expected the end of the first line, got %d", got)
+	}
+	if got := positionToOffset(text, lspPosition{5, 0}); got != len(text) {
+		t.Errorf("Expected the end of the text, got %d", got)
+	}
+}
+
+func collectComments(node *sitter.Node, source []byte) []string {
+	var comments []string
+	for ch := range eachChild(node) {
+		if ch.Kind() == "comment" {
+			comments = append(comments, ch.Utf8Text(source))
+		}
+		comments = append(comments, collectComments(ch, source)...)
+	}
+	return comments
+}
+
+// unifiedDiff returns the lines that differ between want and got, with
+// three lines of context, in the unified format
+func unifiedDiff(wantName, gotName, want, got string) string {
+	var diff strings.Builder
+	fmt.Fprintf(&diff, "--- %s\n+++ %s\n", wantName, gotName)
+	for _, h := range diffHunks([]byte(want), []byte(got)) {
+		diff.WriteString(h.Diff)
+	}
 	return diff.String()
 }
 
-// Helper function to format special characters in a readable way
-func formatChar(b byte) string {
-	switch b {
-	case '\n':
-		return "\\n"
-	case '\r':
-		return "\\r"
-	case '\t':
-		return "\\t"
-	case ' ':
-		return "·" // Use a visible character for space
-	default:
-		if b < 32 || b > 126 {
-			return fmt.Sprintf("\\x%02x", b)
+// FuzzFormat checks that the formatter never panics, that formatting its
+// output again changes nothing and that comments and string literals are all
+// kept. Inputs that don't parse are only checked for panics.
+func FuzzFormat(f *testing.F) {
+	inputPaths, err := filepath.Glob("testdata/*_input.cr")
+	if err != nil {
+		f.Fatalf("Error listing test files: %v", err)
+	}
+	for _, inputPath := range inputPaths {
+		input, err := os.ReadFile(inputPath)
+		if err != nil {
+			f.Fatalf("Failed to read input file %s: %v", inputPath, err)
+		}
+		f.Add(input)
+	}
+
+	f.Fuzz(func(t *testing.T, input []byte) {
+		parser := newTestParser(t)
+		tree := parser.Parse(input, nil)
+		formatter := newFormatter(input, 4, 80)
+		got := formatter.format(tree.RootNode())
+		if formatter.err != nil || tree.RootNode().HasError() {
+			return
+		}
+
+		gotTree := parser.Parse([]byte(got), nil)
+		if gotTree.RootNode().HasError() {
+			t.Fatalf("Formatted output doesn't parse:\n%s", got)
+		}
+
+		again := newFormatter([]byte(got), 4, 80)
+		if twice := again.format(gotTree.RootNode()); twice != got {
+			t.Fatalf("Formatting is not idempotent:\n%s", unifiedDiff("once", "twice", got, twice))
+		}
+
+		for _, collect := range []func(*sitter.Node, []byte) []string{collectNormalizedComments, collectStrings} {
+			want := collect(tree.RootNode(), input)
+			have := collect(gotTree.RootNode(), []byte(got))
+			slices.Sort(want)
+			slices.Sort(have)
+			if !slices.Equal(want, have) {
+				t.Fatalf("Comments or strings changed: want %q, got %q", want, have)
+			}
+		}
+	})
+}
+
+func collectNormalizedComments(node *sitter.Node, source []byte) []string {
+	comments := collectComments(node, source)
+	for idx, cmt := range comments {
+		comments[idx] = strings.TrimRight(normalizeComment(cmt), " \t")
+	}
+	return comments
+}
+
+// collectStrings returns the text of every string literal under node, with
+// the code in their interpolations left out
+func collectStrings(node *sitter.Node, source []byte) []string {
+	var strs []string
+	for ch := range eachChild(node) {
+		if ch.Kind() != "string" {
+			strs = append(strs, collectStrings(ch, source)...)
+			continue
+		}
+
+		var str strings.Builder
+		for part := range eachChild(ch) {
+			if part.Kind() == "interpolation" {
+				str.WriteString("#{}")
+				strs = append(strs, collectStrings(part, source)...)
+				continue
+			}
+			str.WriteString(part.Utf8Text(source))
 		}
-		return string(b)
+		strs = append(strs, str.String())
 	}
+	return strs
 }
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+	"strings"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// A part of the source, from the byte at start up to the one at end
+type byteRange struct {
+	start int
+	end   int
+}
+
+// selectLines adds the statements covering the lines from first to last,
+// counted from 1, to what is formatted
+func (f *Formatter) selectLines(first, last int) error {
+	lineCount := len(f.lineStartPositions)
+	if strings.HasSuffix(string(f.source), "\n") {
+		lineCount--
+	}
+	if first < 1 || last < first || first > lineCount {
+		return fmt.Errorf("invalid line range %d:%d for a file of %d lines", first, last, lineCount)
+	}
+
+	end := len(f.source)
+	if last < lineCount {
+		end = f.lineStartPositions[last] - 1
+	}
+	f.selections = append(f.selections, byteRange{start: f.lineStartPositions[first-1], end: end})
+	return nil
+}
+
+// selectBytes adds the statements covering length bytes from offset to what
+// is formatted. A length of 0 selects the statement at offset.
+func (f *Formatter) selectBytes(offset, length int) error {
+	if offset < 0 || length < 0 || offset+length > len(f.source) {
+		return fmt.Errorf("invalid range of %d bytes at offset %d for a file of %d bytes",
+			length, offset, len(f.source))
+	}
+	f.selections = append(f.selections, byteRange{start: offset, end: offset + length})
+	return nil
+}
+
+// formatSelection formats the statements covering the selections at the
+// indentation they already have, and returns the source with only them
+// replaced
+func (f *Formatter) formatSelection(root *sitter.Node) string {
+	var out strings.Builder
+	f.formatted = []byteRange{}
+	pos := 0
+	for _, stmts := range f.selectedRuns(root) {
+		start := f.getNodeStartPosition(stmts[0])
+		formatted := f.formatRun(stmts)
+		out.Write(f.source[pos:start])
+		f.formatted = append(f.formatted, byteRange{start: out.Len(), end: out.Len() + len(formatted)})
+		out.WriteString(formatted)
+		pos = f.getNodeEndPosition(stmts[len(stmts)-1])
+	}
+	out.Write(f.source[pos:])
+	return out.String()
+}
+
+// formatRun formats consecutive statements of a body
+func (f *Formatter) formatRun(stmts []*sitter.Node) string {
+	// The statements are laid out after whatever precedes them on their
+	// line, as they would be when formatting the whole file
+	lineStart := f.lineStartPositions[stmts[0].Range().StartPoint.Row]
+	prefix := string(f.source[lineStart:f.getNodeStartPosition(stmts[0])])
+	doc := concatDoc(textDoc(prefix))
+	f.docStack = []*Doc{doc}
+	f.formatStatements(stmts, f.sourceLineIndent(stmts[0]), false)
+	for _, stmt := range stmts {
+		if stmt.Kind() == "comment" && !f.emittedComments[stmt.Id()] && f.err == nil {
+			f.err = fmt.Errorf("comment at line %d would be lost: %s",
+				stmt.Range().StartPoint.Row+1, f.getContent(stmt))
+		}
+		f.checkComments(stmt)
+	}
+	return strings.TrimPrefix(f.print(doc), prefix)
+}
+
+// selectedRuns returns the runs of statements covering the selections, in
+// the order of the source. Runs of the same body that overlap are merged,
+// and runs inside a statement of another one are left out.
+func (f *Formatter) selectedRuns(root *sitter.Node) [][]*sitter.Node {
+	var runs [][]*sitter.Node
+	for _, sel := range f.selections {
+		if stmts := f.selectedStatements(root, sel); len(stmts) > 0 {
+			runs = append(runs, stmts)
+		}
+	}
+
+	runStart := func(run []*sitter.Node) int { return f.getNodeStartPosition(run[0]) }
+	runEnd := func(run []*sitter.Node) int { return f.getNodeEndPosition(run[len(run)-1]) }
+	slices.SortFunc(runs, func(a, b []*sitter.Node) int {
+		return cmp.Or(cmp.Compare(runStart(a), runStart(b)), cmp.Compare(runEnd(b), runEnd(a)))
+	})
+
+	var merged [][]*sitter.Node
+	for _, run := range runs {
+		if len(merged) == 0 || runStart(run) >= runEnd(merged[len(merged)-1]) {
+			merged = append(merged, run)
+			continue
+		}
+		last := merged[len(merged)-1]
+		if run[0].Parent().Id() != last[0].Parent().Id() {
+			continue
+		}
+		for _, stmt := range run {
+			if f.getNodeStartPosition(stmt) >= runEnd(last) {
+				last = append(last, stmt)
+			}
+		}
+		merged[len(merged)-1] = last
+	}
+	return merged
+}
+
+// selectedStatements returns the smallest run of consecutive statements of a
+// body covering sel
+func (f *Formatter) selectedStatements(root *sitter.Node, sel byteRange) []*sitter.Node {
+	// Whitespace around the selection, like the indentation of its first
+	// line, doesn't make it cover the body holding its statements
+	start, end := sel.start, sel.end
+	for start < end && isWhitespace(f.source[start]) {
+		start++
+	}
+	for end > start && isWhitespace(f.source[end-1]) {
+		end--
+	}
+	if start == end && sel.start != sel.end {
+		return nil
+	}
+	end = max(end, start+1)
+
+	node := root.DescendantForByteRange(uint(start), uint(end))
+	for node.Parent() != nil && !isStatementList(node) && !isStatementList(node.Parent()) {
+		node = node.Parent()
+	}
+	var stmts []*sitter.Node
+	if isStatementList(node) {
+		stmts = f.statementsInRange(node, start, end)
+	} else if node.Parent() != nil && !f.isInVerbatimRegion(node) {
+		stmts = []*sitter.Node{node}
+	}
+	if len(stmts) == 0 {
+		return nil
+	}
+
+	// Heredoc bodies come after the statement holding their start, and
+	// comments at the end of its line go along with the last one
+	for stmts[0].Kind() == "heredoc_body" && stmts[0].PrevSibling() != nil {
+		stmts = append([]*sitter.Node{stmts[0].PrevSibling()}, stmts...)
+	}
+	for last := stmts[len(stmts)-1]; last.NextSibling() != nil; {
+		next := last.NextSibling()
+		isTrailingComment := next.Kind() == "comment" && next.Range().StartPoint.Row == last.Range().EndPoint.Row
+		if next.Kind() != "heredoc_body" && !isTrailingComment {
+			break
+		}
+		last = next
+		stmts = append(stmts, last)
+	}
+	return stmts
+}
+
+// statementsInRange returns the statements of body between start and end
+func (f *Formatter) statementsInRange(body *sitter.Node, start, end int) []*sitter.Node {
+	var stmts []*sitter.Node
+	for ch := range eachChild(body) {
+		if f.getNodeEndPosition(ch) <= start || f.getNodeStartPosition(ch) >= end {
+			continue
+		}
+		// Comments at the end of the line of a statement left out stay
+		// with it
+		if len(stmts) == 0 && ch.Kind() == "comment" {
+			if prev := ch.PrevSibling(); prev != nil && prev.Range().EndPoint.Row == ch.Range().StartPoint.Row {
+				continue
+			}
+		}
+		// So do statements written verbatim along with one left out
+		if len(stmts) == 0 && f.isInVerbatimRegion(ch) {
+			continue
+		}
+		stmts = append(stmts, ch)
+	}
+	return stmts
+}
+
+// isStatementList reports whether node is a body whose children are
+// statements, each on its own line
+func isStatementList(node *sitter.Node) bool {
+	switch node.Kind() {
+	case "expressions":
+		first := node.Child(0)
+		return first == nil || first.Kind() != "("
+	case "then":
+		return true
+	}
+	return false
+}
+
+// isInVerbatimRegion reports whether node is part of a region of the source
+// written as it is, other than the first node of one
+func (f *Formatter) isInVerbatimRegion(node *sitter.Node) bool {
+	start := f.getNodeStartPosition(node)
+	for _, region := range f.verbatimRegions {
+		if start > region.start && start < region.end {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,298 @@
+package main
+
+import (
+	"cmp"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"slices"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// Values of --format
+const (
+	reportJSON       = "json"
+	reportSARIF      = "sarif"
+	reportCheckstyle = "checkstyle"
+)
+
+// Statuses of the files in a report
+const (
+	statusFormatted = "formatted"
+	statusUnchanged = "unchanged"
+	statusError     = "error"
+)
+
+// A node of a kind the formatter doesn't know, by the offset where it starts
+type unsupportedNode struct {
+	kind   string
+	offset int
+}
+
+// What formatting a file gave, for --format. Files with syntax errors are
+// in error, and formatted files come with the hunks of the diff formatting
+// them.
+type fileReport struct {
+	File             string         `json:"file"`
+	Status           string         `json:"status"`
+	Error            string         `json:"error,omitempty"`
+	SyntaxErrors     []syntaxError  `json:"syntaxErrors"`
+	UnsupportedNodes []reportedNode `json:"unsupportedNodes"`
+	Hunks            []hunk         `json:"hunks"`
+}
+
+type syntaxError struct {
+	Position editPosition `json:"position"`
+	Message  string       `json:"message"`
+}
+
+type reportedNode struct {
+	Position editPosition `json:"position"`
+	Kind     string       `json:"kind"`
+}
+
+// newFileReport reports what formatting source gave
+func newFileReport(filename string, source []byte, root *sitter.Node, f *Formatter, formatted string) fileReport {
+	report := fileReport{
+		File:             filename,
+		Status:           statusUnchanged,
+		SyntaxErrors:     []syntaxError{},
+		UnsupportedNodes: []reportedNode{},
+		Hunks:            []hunk{},
+	}
+
+	diagnostics := []diagnostic{}
+	collectSyntaxErrors(root, source, &diagnostics)
+	for _, d := range diagnostics {
+		report.SyntaxErrors = append(report.SyntaxErrors, syntaxError{
+			Position: positionOf(source, positionToOffset(source, d.Range.Start)),
+			Message:  d.Message,
+		})
+	}
+
+	// Nodes may be formatted more than once, while trying layouts
+	unsupported := slices.SortedFunc(slices.Values(f.unsupported), func(a, b unsupportedNode) int {
+		return cmp.Or(cmp.Compare(a.offset, b.offset), cmp.Compare(a.kind, b.kind))
+	})
+	for _, node := range slices.Compact(unsupported) {
+		report.UnsupportedNodes = append(report.UnsupportedNodes, reportedNode{
+			Position: positionOf(source, node.offset),
+			Kind:     node.kind,
+		})
+	}
+
+	switch {
+	case f.err != nil:
+		report.Status = statusError
+		report.Error = f.err.Error()
+	case len(report.SyntaxErrors) > 0:
+		report.Status = statusError
+	case formatted != string(source):
+		report.Status = statusFormatted
+		report.Hunks = append(report.Hunks, diffHunks(source, []byte(formatted))...)
+	}
+	return report
+}
+
+// A problem of a file, as code scanning tools list them. Line 0 stands for
+// the whole file.
+type finding struct {
+	rule     string
+	severity string
+	line     int
+	column   int
+	endLine  int
+	message  string
+}
+
+// Rules of the findings, with what they're about
+var findingRules = []struct{ id, description string }{
+	{"formatting", "Code that isn't formatted"},
+	{"format-error", "File that couldn't be formatted"},
+	{"syntax-error", "Syntax error"},
+	{"unsupported-node", "Code the formatter leaves as it is"},
+}
+
+// findings lists the problems of a file. Formatting it is only worth a note
+// once it's written.
+func (r fileReport) findings(isWritten bool) []finding {
+	var findings []finding
+	if r.Error != "" {
+		findings = append(findings, finding{
+			rule:     "format-error",
+			severity: "error",
+			message:  "Unable to format: " + r.Error,
+		})
+	}
+	for _, e := range r.SyntaxErrors {
+		findings = append(findings, finding{
+			rule:     "syntax-error",
+			severity: "error",
+			line:     e.Position.Line,
+			column:   e.Position.UTF16Column,
+			message:  e.Message,
+		})
+	}
+	for _, node := range r.UnsupportedNodes {
+		findings = append(findings, finding{
+			rule:     "unsupported-node",
+			severity: "note",
+			line:     node.Position.Line,
+			column:   node.Position.UTF16Column,
+			message:  fmt.Sprintf("%s isn't supported, and was left as it is", node.Kind),
+		})
+	}
+	for _, h := range r.Hunks {
+		f := finding{
+			rule:     "formatting",
+			severity: "warning",
+			line:     max(h.OldStart, 1),
+			endLine:  max(h.OldStart+h.OldLines-1, 1),
+			message:  "Not formatted:\n" + h.Diff,
+		}
+		if isWritten {
+			f.severity = "note"
+			f.message = "Formatted:\n" + h.Diff
+		}
+		findings = append(findings, f)
+	}
+	return findings
+}
+
+// printReport prints the reports of the files in the given format
+func printReport(out io.Writer, format string, reports []fileReport, isWritten bool) error {
+	switch format {
+	case reportSARIF:
+		return printSARIF(out, reports, isWritten)
+	case reportCheckstyle:
+		return printCheckstyle(out, reports, isWritten)
+	default:
+		return json.NewEncoder(out).Encode(struct {
+			Files []fileReport `json:"files"`
+		}{Files: reports})
+	}
+}
+
+// printSARIF prints the findings as a SARIF 2.1.0 log, which code scanning
+// services show as annotations
+func printSARIF(out io.Writer, reports []fileReport, isWritten bool) error {
+	type message struct {
+		Text string `json:"text"`
+	}
+	type region struct {
+		StartLine   int `json:"startLine"`
+		StartColumn int `json:"startColumn,omitempty"`
+		EndLine     int `json:"endLine,omitempty"`
+	}
+	type artifactLocation struct {
+		URI string `json:"uri"`
+	}
+	type physicalLocation struct {
+		ArtifactLocation artifactLocation `json:"artifactLocation"`
+		Region           *region          `json:"region,omitempty"`
+	}
+	type location struct {
+		PhysicalLocation physicalLocation `json:"physicalLocation"`
+	}
+	type result struct {
+		RuleID    string     `json:"ruleId"`
+		Level     string     `json:"level"`
+		Message   message    `json:"message"`
+		Locations []location `json:"locations"`
+	}
+	type rule struct {
+		ID               string  `json:"id"`
+		ShortDescription message `json:"shortDescription"`
+	}
+
+	rules := []rule{}
+	for _, r := range findingRules {
+		rules = append(rules, rule{ID: r.id, ShortDescription: message{Text: r.description}})
+	}
+	results := []result{}
+	for _, report := range reports {
+		uri := (&url.URL{Path: filepath.ToSlash(report.File)}).String()
+		for _, f := range report.findings(isWritten) {
+			loc := physicalLocation{ArtifactLocation: artifactLocation{URI: uri}}
+			if f.line > 0 {
+				loc.Region = &region{StartLine: f.line, StartColumn: f.column, EndLine: f.endLine}
+			}
+			results = append(results, result{
+				RuleID:    f.rule,
+				Level:     f.severity,
+				Message:   message{Text: f.message},
+				Locations: []location{{PhysicalLocation: loc}},
+			})
+		}
+	}
+
+	log := map[string]any{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs": []any{map[string]any{
+			"tool": map[string]any{"driver": map[string]any{
+				"name":  "crystalfmt",
+				"rules": rules,
+			}},
+			"results": results,
+		}},
+	}
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(log)
+}
+
+// printCheckstyle prints the findings as a Checkstyle report, which most CI
+// services read
+func printCheckstyle(out io.Writer, reports []fileReport, isWritten bool) error {
+	type checkstyleError struct {
+		Line     int    `xml:"line,attr"`
+		Column   int    `xml:"column,attr,omitempty"`
+		Severity string `xml:"severity,attr"`
+		Message  string `xml:"message,attr"`
+		Source   string `xml:"source,attr"`
+	}
+	type checkstyleFile struct {
+		Name   string            `xml:"name,attr"`
+		Errors []checkstyleError `xml:"error"`
+	}
+	type checkstyle struct {
+		XMLName xml.Name         `xml:"checkstyle"`
+		Version string           `xml:"version,attr"`
+		Files   []checkstyleFile `xml:"file"`
+	}
+
+	result := checkstyle{Version: "4.3"}
+	for _, report := range reports {
+		file := checkstyleFile{Name: report.File}
+		for _, f := range report.findings(isWritten) {
+			severity := f.severity
+			if severity == "note" {
+				severity = "info"
+			}
+			file.Errors = append(file.Errors, checkstyleError{
+				Line:     max(f.line, 1),
+				Column:   f.column,
+				Severity: severity,
+				Message:  f.message,
+				Source:   "crystalfmt." + f.rule,
+			})
+		}
+		result.Files = append(result.Files, file)
+	}
+
+	if _, err := io.WriteString(out, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(out)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		return err
+	}
+	_, err := io.WriteString(out, "\n")
+	return err
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// A Crystal file staged for commit, and what formatting it gives
+type stagedFile struct {
+	// Relative to the top of the working tree
+	path      string
+	mode      string
+	blob      []byte
+	formatted []byte
+
+	// What to write to the working tree, or nil to leave it as it is
+	worktree []byte
+}
+
+// formatStaged formats the content of the Crystal files staged for commit in
+// the repository holding dir, and writes it back to the index. The working
+// tree is updated too when its changes can be merged with the formatting.
+// Nothing is written unless every file can be formatted.
+//
+// Within a pre-commit hook, git points $GIT_INDEX_FILE to the index being
+// committed, which the git commands run here inherit. Commits of given paths
+// use a temporary index instead, and files needing formatting are refused
+// then, since the repository's own index would keep them unformatted.
+func formatStaged(parser *sitter.Parser, dir string, opts options, log io.Writer) error {
+	out, err := runGit(dir, nil, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return err
+	}
+	top := strings.TrimSpace(string(out))
+
+	isPartialCommit, err := isTemporaryIndex(top)
+	if err != nil {
+		return err
+	}
+
+	out, err = runGit(top, nil, "diff", "--cached", "--name-only", "-z", "--diff-filter=ACMRU", "--", "*.cr")
+	if err != nil {
+		return err
+	}
+	isStaged := map[string]bool{}
+	for _, name := range strings.Split(string(out), "\x00") {
+		if name != "" {
+			isStaged[name] = true
+		}
+	}
+	if len(isStaged) == 0 {
+		return nil
+	}
+
+	// Entries are "<mode> <object> <stage>\t<path>"; unmerged files have
+	// one for each side, in stages 1 to 3
+	out, err = runGit(top, nil, "ls-files", "--stage", "-z", "--", "*.cr")
+	if err != nil {
+		return err
+	}
+	var files []*stagedFile
+	var problems []string
+	isConflicted := map[string]bool{}
+	for _, entry := range strings.Split(string(out), "\x00") {
+		info, path, ok := strings.Cut(entry, "\t")
+		fields := strings.Fields(info)
+		if !ok || len(fields) != 3 || !isStaged[path] {
+			continue
+		}
+		mode, object, stage := fields[0], fields[1], fields[2]
+		if stage != "0" {
+			if !isConflicted[path] {
+				isConflicted[path] = true
+				problems = append(problems, fmt.Sprintf("%s has merge conflicts, resolve them before committing", path))
+			}
+			continue
+		}
+		// Symlinks and submodules hold no Crystal code
+		if mode != "100644" && mode != "100755" {
+			continue
+		}
+
+		blob, err := runGit(top, nil, "cat-file", "blob", object)
+		if err != nil {
+			return err
+		}
+		files = append(files, &stagedFile{path: path, mode: mode, blob: blob})
+	}
+
+	var changed []*stagedFile
+	for _, file := range files {
+		tree := parser.Parse(file.blob, nil)
+		f := opts.formatterFor(file.blob)
+		formatted := f.format(tree.RootNode())
+		for _, warning := range f.warnings {
+			fmt.Fprintf(log, "%s: warning: %s\n", file.path, warning)
+		}
+		if f.err == nil {
+			f.err = f.verify(parser, tree, formatted)
+		}
+		tree.Close()
+		if f.err != nil {
+			problems = append(problems, fmt.Sprintf("%s: unable to format the staged content: %v", file.path, f.err))
+			continue
+		}
+		if formatted == string(file.blob) {
+			continue
+		}
+		file.formatted = []byte(formatted)
+		if isPartialCommit {
+			problems = append(problems, fmt.Sprintf(
+				"%s needs formatting, which can't be written back when committing given paths, stage it and commit without paths instead", file.path))
+			continue
+		}
+
+		current, err := os.ReadFile(filepath.Join(top, file.path))
+		switch {
+		case errors.Is(err, os.ErrNotExist):
+			// Removed from the working tree but not from the index
+		case err != nil:
+			return err
+		case bytes.Equal(current, file.blob):
+			file.worktree = file.formatted
+		default:
+			merged, err := mergeFile(current, file.blob, file.formatted)
+			if err != nil {
+				problems = append(problems, fmt.Sprintf(
+					"%s: formatting the staged content conflicts with the changes left unstaged, stage or stash them before committing", file.path))
+				continue
+			}
+			file.worktree = merged
+		}
+		changed = append(changed, file)
+	}
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
+
+	for _, file := range changed {
+		out, err := runGit(top, file.formatted, "hash-object", "-w", "--no-filters", "--stdin")
+		if err != nil {
+			return err
+		}
+		object := strings.TrimSpace(string(out))
+		if _, err := runGit(top, nil, "update-index", "--cacheinfo", file.mode+","+object+","+file.path); err != nil {
+			return err
+		}
+
+		if file.worktree != nil {
+			if _, err := writeFileAtomic(filepath.Join(top, file.path), file.worktree); err != nil {
+				return err
+			}
+			fmt.Fprintf(log, "%s was formatted\n", file.path)
+		} else {
+			fmt.Fprintf(log, "%s was formatted in the index only\n", file.path)
+		}
+	}
+	return nil
+}
+
+// isTemporaryIndex reports whether $GIT_INDEX_FILE points to an index other
+// than the repository's own, as git does while committing given paths. The
+// own index is locked while committing all that is staged, so its lock file
+// counts as the own index too.
+func isTemporaryIndex(top string) (bool, error) {
+	indexFile := os.Getenv("GIT_INDEX_FILE")
+	if indexFile == "" {
+		return false, nil
+	}
+	if !filepath.IsAbs(indexFile) {
+		indexFile = filepath.Join(top, indexFile)
+	}
+
+	out, err := runGit(top, nil, "rev-parse", "--absolute-git-dir")
+	if err != nil {
+		return false, err
+	}
+	ownIndex := filepath.Join(strings.TrimSpace(string(out)), "index")
+	for _, path := range []string{ownIndex, ownIndex + ".lock"} {
+		if sameFile(indexFile, path) {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// sameFile reports whether two paths name the same file, which may not
+// exist yet
+func sameFile(a, b string) bool {
+	if filepath.Clean(a) == filepath.Clean(b) {
+		return true
+	}
+	aInfo, aErr := os.Stat(a)
+	bInfo, bErr := os.Stat(b)
+	return aErr == nil && bErr == nil && os.SameFile(aInfo, bInfo)
+}
+
+// mergeFile applies the changes from base to other to current, and fails if
+// they overlap changes from base to current
+func mergeFile(current, base, other []byte) ([]byte, error) {
+	dir, err := os.MkdirTemp("", "crystalfmt-merge-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	names := []string{"current", "base", "other"}
+	for idx, content := range [][]byte{current, base, other} {
+		if err := os.WriteFile(filepath.Join(dir, names[idx]), content, 0600); err != nil {
+			return nil, err
+		}
+	}
+
+	// The exit status is the number of conflicts
+	cmd := exec.Command("git", "merge-file", "-p", "--quiet", "current", "base", "other")
+	cmd.Dir = dir
+	merged, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git merge-file failed: %w", err)
+	}
+	return merged, nil
+}
+
+// runGit runs git in dir, with stdin as its input if not nil, and returns
+// what it prints
+func runGit(dir string, stdin []byte, args ...string) ([]byte, error) {
+	var stderr bytes.Buffer
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("git %s failed: %w: %s", args[0], err, strings.TrimSpace(stderr.String()))
+	}
+	return out, nil
+}
+
+// The line marking the pre-commit hooks crystalfmt installed
+const hookMarker = "# Installed by crystalfmt hook install"
+
+// installHook installs a pre-commit hook formatting the staged Crystal files
+// in the repository holding dir, and returns its path. A pre-commit hook
+// installed by something else is left alone.
+func installHook(dir string) (string, error) {
+	out, err := runGit(dir, nil, "rev-parse", "--git-path", "hooks")
+	if err != nil {
+		return "", err
+	}
+	hooks := strings.TrimSpace(string(out))
+	if !filepath.IsAbs(hooks) {
+		hooks = filepath.Join(dir, hooks)
+	}
+	path := filepath.Join(hooks, "pre-commit")
+
+	existing, err := os.ReadFile(path)
+	if err == nil && !bytes.Contains(existing, []byte(hookMarker)) {
+		return "", fmt.Errorf("%s already exists, add crystalfmt --staged to it instead", path)
+	}
+
+	// crystalfmt is looked up in $PATH, so the hook keeps working when it's
+	// moved or upgraded
+	script := "#!/bin/sh\n" + hookMarker + "\nexec crystalfmt --staged\n"
+
+	if err := os.MkdirAll(hooks, 0755); err != nil {
+		return "", err
+	}
+	if err := os.WriteFile(path, []byte(script), 0755); err != nil {
+		return "", err
+	}
+	// WriteFile keeps the mode of a hook written before
+	return path, os.Chmod(path, 0755)
+}
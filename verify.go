@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// verify makes sure that formatting didn't change what the program means and
+// that formatting the result again, or the part of it that was formatted,
+// changes nothing. The formatted source must parse into the same tree as the
+// original, ignoring comments, whitespace and the trailing commas the
+// formatter adds or removes.
+func (f *Formatter) verify(parser *sitter.Parser, tree *sitter.Tree, formatted string) error {
+	output := []byte(formatted)
+	outputTree := parser.Parse(output, nil)
+	defer outputTree.Close()
+
+	if err := compareTrees(tree.RootNode(), f.source, outputTree.RootNode(), output); err != nil {
+		return fmt.Errorf("formatting changed the syntax tree: %w", err)
+	}
+
+	again := newFormatter(output, f.indentSize, f.lineWidth)
+	again.alignComments = f.alignComments
+	again.wrapComments = f.wrapComments
+	if f.selections != nil {
+		again.selections = f.formatted
+	}
+	reformatted := again.format(outputTree.RootNode())
+	if again.err != nil {
+		return fmt.Errorf("formatting the output again failed: %w", again.err)
+	}
+	if reformatted != formatted {
+		return fmt.Errorf("formatting is not idempotent: %s", firstDifferentLine(formatted, reformatted))
+	}
+
+	return nil
+}
+
+// compareTrees reports the first difference between two syntax trees
+func compareTrees(want *sitter.Node, wantSource []byte, got *sitter.Node, gotSource []byte) error {
+	if want.Kind() != got.Kind() {
+		return fmt.Errorf("%s became %s", describeNode(want, wantSource), describeNode(got, gotSource))
+	}
+
+	if want.ChildCount() == 0 && got.ChildCount() == 0 {
+		if !equalTokens(want, wantSource, got, gotSource) {
+			return fmt.Errorf("%s became %s", describeNode(want, wantSource), describeNode(got, gotSource))
+		}
+		return nil
+	}
+
+	wantChildren := comparedChildren(want)
+	gotChildren := comparedChildren(got)
+	for idx := range min(len(wantChildren), len(gotChildren)) {
+		if err := compareTrees(wantChildren[idx], wantSource, gotChildren[idx], gotSource); err != nil {
+			return err
+		}
+	}
+
+	switch {
+	case len(wantChildren) > len(gotChildren):
+		return fmt.Errorf("%s was dropped from %s",
+			describeNode(wantChildren[len(gotChildren)], wantSource), describeNode(got, gotSource))
+	case len(wantChildren) < len(gotChildren):
+		return fmt.Errorf("%s was added to %s",
+			describeNode(gotChildren[len(wantChildren)], gotSource), describeNode(got, gotSource))
+	}
+	return nil
+}
+
+// comparedChildren returns the children of node that matter to what the
+// program means
+func comparedChildren(node *sitter.Node) []*sitter.Node {
+	var children []*sitter.Node
+	for ch := range eachChild(node) {
+		if ch.Kind() == "comment" {
+			continue
+		}
+		// Trailing commas
+		if ch.Kind() == "," {
+			next := ch.NextSibling()
+			for next != nil && next.Kind() == "comment" {
+				next = next.NextSibling()
+			}
+			if next == nil || closingDelimiters[next.Kind()] {
+				continue
+			}
+		}
+		children = append(children, ch)
+	}
+	return children
+}
+
+// equalTokens reports whether two tokens have the same text. Heredoc bodies
+// can be reindented along with the line where they start.
+func equalTokens(want *sitter.Node, wantSource []byte, got *sitter.Node, gotSource []byte) bool {
+	wantText := want.Utf8Text(wantSource)
+	gotText := got.Utf8Text(gotSource)
+	if parent := want.Parent(); parent != nil && parent.Kind() == "heredoc_body" {
+		return trimLineIndents(wantText) == trimLineIndents(gotText)
+	}
+	return wantText == gotText
+}
+
+func trimLineIndents(text string) string {
+	lines := strings.Split(text, "\n")
+	for idx, line := range lines {
+		lines[idx] = strings.TrimLeft(line, " \t")
+	}
+	return strings.Join(lines, "\n")
+}
+
+func describeNode(node *sitter.Node, source []byte) string {
+	text := node.Utf8Text(source)
+	if idx := strings.IndexByte(text, '\n'); idx != -1 {
+		text = text[:idx] + "..."
+	}
+	pos := node.Range().StartPoint
+	return fmt.Sprintf("%s %q at line %d, column %d", node.Kind(), text, pos.Row+1, pos.Column+1)
+}
+
+// firstDifferentLine describes the first line where two outputs differ
+func firstDifferentLine(want, got string) string {
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	for idx := range max(len(wantLines), len(gotLines)) {
+		var wantLine, gotLine string
+		if idx < len(wantLines) {
+			wantLine = wantLines[idx]
+		}
+		if idx < len(gotLines) {
+			gotLine = gotLines[idx]
+		}
+		if wantLine != gotLine {
+			return fmt.Sprintf("line %d was %q, then %q", idx+1, wantLine, gotLine)
+		}
+	}
+	return "outputs only differ in line endings"
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"time"
+
+	sitter "github.com/tree-sitter/go-tree-sitter"
+)
+
+// How long to wait after a file changes for more changes, so that saving
+// several files or writing one in several steps formats them once
+var watchDebounce = 100 * time.Millisecond
+
+// watch formats the Crystal files under root in place whenever they're
+// written, until stop is closed, and logs a line about each to log
+func watch(parser *sitter.Parser, root string, opts options, log io.Writer, stop <-chan struct{}) error {
+	w, err := newWatcher(root)
+	if err != nil {
+		return err
+	}
+	defer w.close()
+	fmt.Fprintf(log, "Watching %s\n", root)
+
+	// Files are kept parsed between changes, along with what was written to
+	// them, so that the changes made by formatting them are ignored
+	docs := map[string]*document{}
+	written := map[string][]byte{}
+	defer func() {
+		for _, doc := range docs {
+			doc.close()
+		}
+	}()
+
+	pending := map[string]bool{}
+	var debounce <-chan time.Time
+	for {
+		select {
+		case <-stop:
+			return nil
+		case err := <-w.errors:
+			return err
+		case path := <-w.events:
+			pending[path] = true
+			debounce = time.After(watchDebounce)
+		case <-debounce:
+			for _, path := range slices.Sorted(maps.Keys(pending)) {
+				watchFormat(parser, path, opts, docs, written, log)
+			}
+			pending = map[string]bool{}
+		}
+	}
+}
+
+// watchFormat formats a file that changed, unless it has syntax errors
+func watchFormat(parser *sitter.Parser, path string, opts options, docs map[string]*document,
+	written map[string][]byte, log io.Writer) {
+	source, err := os.ReadFile(path)
+	if err != nil {
+		// Removed or renamed since it changed
+		if doc, ok := docs[path]; ok {
+			doc.close()
+			delete(docs, path)
+		}
+		return
+	}
+	if bytes.Equal(source, written[path]) {
+		return
+	}
+	delete(written, path)
+
+	doc, ok := docs[path]
+	if ok {
+		doc.replace(source)
+	} else {
+		doc = newDocument(parser, source)
+		docs[path] = doc
+	}
+
+	if doc.tree.RootNode().HasError() {
+		fmt.Fprintf(log, "%s: left as is because of syntax errors\n", path)
+		diagnostics := []diagnostic{}
+		collectSyntaxErrors(doc.tree.RootNode(), doc.text, &diagnostics)
+		for _, d := range diagnostics {
+			fmt.Fprintf(log, "%s:%d:%d: %s\n", path, d.Range.Start.Line+1, d.Range.Start.Character+1, d.Message)
+		}
+		return
+	}
+
+	f := opts.formatterFor(doc.text)
+	formatted := f.format(doc.tree.RootNode())
+	for _, warning := range f.warnings {
+		fmt.Fprintf(log, "%s: warning: %s\n", path, warning)
+	}
+	if f.err == nil {
+		f.err = f.verify(parser, doc.tree, formatted)
+	}
+	switch {
+	case f.err != nil:
+		fmt.Fprintf(log, "%s: unable to format: %v\n", path, f.err)
+	case formatted == string(source):
+		fmt.Fprintf(log, "%s: already formatted\n", path)
+	default:
+		if _, err := writeFileAtomic(path, []byte(formatted)); err != nil {
+			fmt.Fprintf(log, "%s: %v\n", path, err)
+			return
+		}
+		written[path] = []byte(formatted)
+		fmt.Fprintf(log, "%s: formatted\n", path)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Events on directories that mean that a file in them was written, or that
+// a directory was added to them
+const watchMask = syscall.IN_CLOSE_WRITE | syscall.IN_MOVED_TO | syscall.IN_CREATE
+
+// watcher reports the Crystal files written under a directory, using inotify
+type watcher struct {
+	events chan string
+	errors chan error
+
+	// The inotify instance, read through the runtime's poller so that
+	// closing it stops reading
+	fd   int
+	file *os.File
+	done chan struct{}
+
+	// Directories watched, by watch descriptor
+	mu   sync.Mutex
+	dirs map[int]string
+}
+
+func newWatcher(root string) (*watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, fmt.Errorf("unable to watch files: %w", err)
+	}
+
+	w := &watcher{
+		events: make(chan string),
+		errors: make(chan error, 1),
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		done:   make(chan struct{}),
+		dirs:   map[int]string{},
+	}
+	if _, err := w.addTree(root); err != nil {
+		w.close()
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+// addTree watches dir and every directory under it, except hidden ones like
+// .git, and returns the Crystal files already in them
+func (w *watcher) addTree(dir string) ([]string, error) {
+	var files []string
+	err := filepath.WalkDir(dir, func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !entry.IsDir() {
+			if strings.HasSuffix(path, ".cr") {
+				files = append(files, path)
+			}
+			return nil
+		}
+		if path != dir && strings.HasPrefix(entry.Name(), ".") {
+			return filepath.SkipDir
+		}
+
+		wd, err := syscall.InotifyAddWatch(w.fd, path, watchMask)
+		if err != nil {
+			return fmt.Errorf("unable to watch %s: %w", path, err)
+		}
+		w.mu.Lock()
+		w.dirs[wd] = path
+		w.mu.Unlock()
+		return nil
+	})
+	return files, err
+}
+
+// read reports the events of the watched directories until the watcher is
+// closed
+func (w *watcher) read() {
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	for {
+		n, err := w.file.Read(buf)
+		if err != nil {
+			// Reading fails once the watcher is closed
+			return
+		}
+
+		for offset := 0; offset+syscall.SizeofInotifyEvent <= n; {
+			event := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[offset]))
+			nameBytes := buf[offset+syscall.SizeofInotifyEvent : offset+syscall.SizeofInotifyEvent+int(event.Len)]
+			offset += syscall.SizeofInotifyEvent + int(event.Len)
+
+			w.mu.Lock()
+			dir, ok := w.dirs[int(event.Wd)]
+			if event.Mask&syscall.IN_IGNORED != 0 {
+				delete(w.dirs, int(event.Wd))
+			}
+			w.mu.Unlock()
+			if !ok || event.Len == 0 {
+				continue
+			}
+
+			path := filepath.Join(dir, strings.TrimRight(string(nameBytes), "\x00"))
+			var changed []string
+			switch {
+			case event.Mask&syscall.IN_ISDIR != 0:
+				// Files can be written to a directory before it's watched
+				if event.Mask&(syscall.IN_CREATE|syscall.IN_MOVED_TO) != 0 {
+					files, err := w.addTree(path)
+					if err != nil && !os.IsNotExist(err) {
+						w.errors <- err
+						return
+					}
+					changed = files
+				}
+			case event.Mask&(syscall.IN_CLOSE_WRITE|syscall.IN_MOVED_TO) != 0 && strings.HasSuffix(path, ".cr"):
+				changed = []string{path}
+			}
+
+			for _, path := range changed {
+				select {
+				case w.events <- path:
+				case <-w.done:
+					return
+				}
+			}
+		}
+	}
+}
+
+func (w *watcher) close() {
+	close(w.done)
+	w.file.Close()
+}
@@ -0,0 +1,18 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// watcher reports the Crystal files written under a directory. It relies on
+// inotify, so watching only works on Linux.
+type watcher struct {
+	events chan string
+	errors chan error
+}
+
+func newWatcher(root string) (*watcher, error) {
+	return nil, fmt.Errorf("unable to watch %s: watching files is only supported on Linux", root)
+}
+
+func (w *watcher) close() {}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// writeFileAtomic replaces the content of a file with data, and reports
+// whether it changed. Files already holding data aren't written at all, so
+// their modification time stays the same.
+//
+// The data is written to a temporary file in the same directory, which is
+// then renamed over the file, so that a crash never leaves it half written.
+// The file keeps its mode. Symlinks are followed: the file they point to is
+// replaced, and they stay links to it.
+func writeFileAtomic(filename string, data []byte) (bool, error) {
+	target, err := filepath.EvalSymlinks(filename)
+	if err != nil {
+		return false, err
+	}
+	info, err := os.Stat(target)
+	if err != nil {
+		return false, err
+	}
+	if !info.Mode().IsRegular() {
+		return false, fmt.Errorf("%s is not a regular file", filename)
+	}
+
+	current, err := os.ReadFile(target)
+	if err != nil {
+		return false, err
+	}
+	if bytes.Equal(current, data) {
+		return false, nil
+	}
+
+	dir := filepath.Dir(target)
+	tmp, err := os.CreateTemp(dir, "."+filepath.Base(target)+".crystalfmt-*")
+	if err != nil {
+		return false, err
+	}
+	isRenamed := false
+	defer func() {
+		if !isRenamed {
+			tmp.Close()
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if _, err := tmp.Write(data); err != nil {
+		return false, err
+	}
+	if err := tmp.Chmod(info.Mode() & (os.ModePerm | os.ModeSetuid | os.ModeSetgid | os.ModeSticky)); err != nil {
+		return false, err
+	}
+	if err := tmp.Sync(); err != nil {
+		return false, err
+	}
+	if err := tmp.Close(); err != nil {
+		return false, err
+	}
+	if err := os.Rename(tmp.Name(), target); err != nil {
+		return false, err
+	}
+	isRenamed = true
+
+	// Make the rename itself last, where the file system allows it
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return true, nil
+}